@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+	"whapp-irc/logger"
+	"whapp-irc/metrics"
+)
+
+// listening is set to 1 by setListening once the IRC and file servers are
+// listening.
+var listening int32
+
+// setListening marks the IRC and file servers as listening.
+func setListening() {
+	atomic.StoreInt32(&listening, 1)
+}
+
+// makeAdminServer makes the HTTP server listening on the given host and port
+// which serves the metrics, health checks and session statuses.
+func makeAdminServer(host, port string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	mux.HandleFunc("/admin/sessions", handleSessions)
+
+	return &http.Server{
+		Addr:    net.JoinHostPort(host, port),
+		Handler: mux,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(v); err != nil {
+		logger.Default().Warningf("error while writing admin response: %s", err)
+	}
+}
+
+// handleHealthz reports whether the process is alive, which it is when it's
+// able to respond.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether whapp-irc is ready to accept connections, which
+// it is when it's listening and not shutting down. When a user is given using
+// the user query parameter it reports whether the session of that user is
+// ready instead. It responds with 503 when not ready.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		listening := atomic.LoadInt32(&listening) == 1
+		closing := connections.Closing()
+		ready := listening && !closing
+
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, struct {
+			Ready     bool `json:"ready"`
+			Listening bool `json:"listening"`
+			Closing   bool `json:"closing"`
+		}{ready, listening, closing})
+		return
+	}
+
+	var sessions []SessionStatus
+	for _, s := range connections.SessionStatuses() {
+		if strings.EqualFold(s.User, user) {
+			sessions = append(sessions, s)
+		}
+	}
+	if len(sessions) == 0 {
+		http.Error(w, "user not connected", http.StatusNotFound)
+		return
+	}
+
+	ready := !connections.Closing()
+	for _, s := range sessions {
+		ready = ready && s.Ready
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, struct {
+		Ready    bool            `json:"ready"`
+		Sessions []SessionStatus `json:"sessions"`
+	}{ready, sessions})
+}
+
+// handleSessions shows the status of the process and of all sessions.
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Commit    string          `json:"commit,omitempty"`
+		StartTime time.Time       `json:"startTime"`
+		Sessions  []SessionStatus `json:"sessions"`
+	}{commit, startTime, connections.SessionStatuses()})
+}
@@ -18,21 +18,24 @@ func (conn *Connection) alternativeReplayWhappMessageHandle(msg whapp.Message) e
 	}
 	chat := item.chat
 
-	if chat.HasMessageID(msg.ID.Serialized) {
+	if !conn.messageIDs.Add(chat.ID.String(), msg.ID.Serialized) {
 		return nil // already handled
 	}
-	chat.AddMessageID(msg.ID.Serialized)
+	// the handled message IDs are saved too, even when the timestamp
+	// doesn't change.
+	conn.persister.MarkDirty()
 
 	lastTimestamp, found := conn.timestampMap.Get(chat.ID.String())
 	if !found || msg.Timestamp > lastTimestamp {
 		conn.timestampMap.Set(chat.ID.String(), msg.Timestamp)
-		go conn.saveDatabaseEntry()
 	}
 
 	if msg.IsNotification {
 		return nil
 	}
 
+	conn.archiveMessage(chat, msg)
+
 	sender := formatContact(*msg.Sender)
 	from := sender.SafeName()
 	if msg.IsSentByMe {
@@ -46,13 +49,13 @@ func (conn *Connection) alternativeReplayWhappMessageHandle(msg whapp.Message) e
 		to = conn.irc.Nick()
 	}
 
-	if err := downloadAndStoreMedia(msg); err != nil {
+	if err := conn.media.Download(msg); err != nil {
 		return err
 	}
 
-	message := getMessageBody(msg, chat.Participants, conn.me)
+	message := conn.getMessageBody(msg, chat.Participants)
 	for _, line := range strings.Split(message, "\n") {
-		logMessage(msg.Time(), from, to, line)
+		conn.logMessage(msg.Time(), from, to, line)
 
 		msg := fmt.Sprintf(
 			"(%s) %s->%s: %s",
@@ -0,0 +1,150 @@
+package archive
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+	"whapp-irc/database/lockmap"
+)
+
+const fileExtension = ".jsonl"
+
+// Message is a message stored in the archive.
+type Message struct {
+	ID        string `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+	Chat      string `json:"chat"`
+	Sender    string `json:"sender"`
+	FromMe    bool   `json:"fromMe,omitempty"`
+	Type      string `json:"type"`
+	Body      string `json:"body,omitempty"`
+	MediaHash string `json:"mediaHash,omitempty"`
+	QuotedID  string `json:"quotedId,omitempty"`
+}
+
+// Time returns the time the current message was sent.
+func (msg Message) Time() time.Time {
+	return time.Unix(msg.Timestamp, 0)
+}
+
+// An Archive stores the messages of every chat of every user as JSON lines in
+// a file per chat.
+type Archive struct {
+	Folder  string
+	lockMap *lockmap.LockMap
+}
+
+// MakeArchive returns a new Archive storing its files in the given folder.
+func MakeArchive(folder string) (*Archive, error) {
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return nil, err
+	}
+
+	return &Archive{
+		Folder:  folder,
+		lockMap: lockmap.New(),
+	}, nil
+}
+
+func (a *Archive) userPath(user string) string {
+	return filepath.Join(a.Folder, url.PathEscape(user))
+}
+
+func (a *Archive) getPath(user, chat string) string {
+	return filepath.Join(a.userPath(user), url.PathEscape(chat)+fileExtension)
+}
+
+// Add appends the given message to the archive of the given user.
+func (a *Archive) Add(user string, msg Message) error {
+	path := a.getPath(user, msg.Chat)
+	unlock := a.lockMap.Lock(path)
+	defer unlock()
+
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	// a write interrupted by a crash leaves a partial line behind, start on a
+	// new line so that only the partial line is lost.
+	torn, err := hasPartialLine(f)
+	if err == nil {
+		if torn {
+			bytes = append([]byte{'\n'}, bytes...)
+		}
+		_, err = f.Write(append(bytes, '\n'))
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// hasPartialLine returns whether the given file doesn't end with a newline.
+func hasPartialLine(f *os.File) (bool, error) {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return false, err
+	}
+
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		return false, err
+	}
+	return last[0] != '\n', nil
+}
+
+// Find returns the messages in the given chat of the given user matching the
+// given query, ordered by the time they were sent.
+// Lines that can't be parsed, such as a line partially written before a crash,
+// are skipped.
+func (a *Archive) Find(user, chat string, query Query) ([]Message, error) {
+	path := a.getPath(user, chat)
+	unlock := a.lockMap.RLock(path)
+	defer unlock()
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var res []Message
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var msg Message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			continue
+		}
+
+		if query.Matches(msg) {
+			res = append(res, msg)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// imported messages can be added after newer messages.
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Timestamp < res[j].Timestamp
+	})
+	return res, nil
+}
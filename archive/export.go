@@ -0,0 +1,175 @@
+package archive
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+)
+
+// Formats are the formats messages can be exported in.
+var Formats = []string{"json", "text", "html"}
+
+// MediaURLFunc returns the URL of the media with the given hash, or an empty
+// string if it isn't available.
+type MediaURLFunc func(hash string) string
+
+// FormatExtension returns the file extension for exports in the given format.
+func FormatExtension(format string) string {
+	switch format {
+	case "json":
+		return "jsonl"
+	case "text":
+		return "log"
+	default:
+		return format
+	}
+}
+
+// FormatMimeType returns the mime type of exports in the given format.
+func FormatMimeType(format string) string {
+	switch format {
+	case "json":
+		return "application/x-ndjson"
+	case "html":
+		return "text/html"
+	default:
+		return "text/plain"
+	}
+}
+
+// Export writes the given messages of the chat with the given name to w in the
+// given format: "json" for JSON lines, "text" for an irssi compatible log, or
+// "html" for a self-contained HTML page.
+func Export(w io.Writer, format, chatName string, messages []Message, mediaURL MediaURLFunc) error {
+	bw := bufio.NewWriter(w)
+
+	var err error
+	switch format {
+	case "json":
+		err = exportJSON(bw, messages)
+	case "text":
+		err = exportText(bw, chatName, messages, mediaURL)
+	case "html":
+		err = exportHTML(bw, chatName, messages, mediaURL)
+
+	default:
+		return fmt.Errorf("unknown export format %s", format)
+	}
+
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func exportJSON(w io.Writer, messages []Message) error {
+	encoder := json.NewEncoder(w)
+	for _, msg := range messages {
+		if err := encoder.Encode(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mediaText returns the text describing the media of the given message.
+func mediaText(msg Message, mediaURL MediaURLFunc) string {
+	if url := mediaURL(msg.MediaHash); url != "" {
+		return url
+	}
+	return "--file--"
+}
+
+func exportText(w io.Writer, chatName string, messages []Message, mediaURL MediaURLFunc) error {
+	const (
+		logTimeFormat = "Mon Jan 02 15:04:05 2006"
+		dayFormat     = "Mon Jan 02 2006"
+	)
+
+	now := time.Now()
+	if len(messages) > 0 {
+		now = messages[0].Time()
+	}
+	fmt.Fprintf(w, "--- Log opened %s\n", now.Format(logTimeFormat))
+
+	var prevDay string
+	for _, msg := range messages {
+		t := msg.Time()
+		if day := t.Format(dayFormat); day != prevDay {
+			if prevDay != "" {
+				fmt.Fprintf(w, "--- Day changed %s\n", day)
+			}
+			prevDay = day
+		}
+
+		body := msg.Body
+		if msg.MediaHash != "" {
+			body = strings.TrimSpace(mediaText(msg, mediaURL) + " " + body)
+		}
+
+		for _, line := range strings.Split(body, "\n") {
+			if _, err := fmt.Fprintf(w, "%s <%s> %s\n", t.Format("15:04"), msg.Sender, line); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "--- Log closed %s\n", time.Now().Format(logTimeFormat))
+	return err
+}
+
+var exportTemplate = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>{{.Chat}}</title>
+	<style>
+		body { font-family: sans-serif; max-width: 50em; margin: 1em auto; padding: 0 1em; }
+		.message { margin: 0.5em 0; }
+		.message.me { text-align: right; }
+		.time, .media { color: #666; }
+		.body { white-space: pre-wrap; }
+	</style>
+</head>
+<body>
+	<h1>{{.Chat}}</h1>
+	{{range .Messages}}
+	<div class="message{{if .FromMe}} me{{end}}">
+		<span class="time">{{.Time.Format "2006-01-02 15:04"}}</span>
+		<strong>{{.Sender}}</strong>
+		{{if .MediaHash}}{{if .MediaURL}}<a class="media" href="{{.MediaURL}}">{{.MediaURL}}</a>{{else}}<span class="media">--file--</span>{{end}}{{end}}
+		<div class="body">{{.Body}}</div>
+	</div>
+	{{end}}
+</body>
+</html>
+`))
+
+type exportMessage struct {
+	Message
+	MediaURL string
+}
+
+func exportHTML(w io.Writer, chatName string, messages []Message, mediaURL MediaURLFunc) error {
+	data := struct {
+		Chat     string
+		Messages []exportMessage
+	}{
+		Chat: chatName,
+	}
+
+	for _, msg := range messages {
+		item := exportMessage{Message: msg}
+		if msg.MediaHash != "" {
+			item.MediaURL = mediaURL(msg.MediaHash)
+		}
+		data.Messages = append(data.Messages, item)
+	}
+
+	return exportTemplate.Execute(w, data)
+}
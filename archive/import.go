@@ -0,0 +1,210 @@
+package archive
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DateOrder is the order of the day and month in the dates of an exported
+// chat, which depends on the locale of the phone it was exported from.
+type DateOrder int
+
+// The possible date orders.
+const (
+	DateOrderAuto DateOrder = iota
+	DateOrderDMY
+	DateOrderMDY
+)
+
+// ImportedMessage is a message parsed from a chat exported using the "Export
+// chat" function of WhatsApp.
+type ImportedMessage struct {
+	Time   time.Time
+	Sender string
+	Body   string
+	// Attachment is the file name of the attached media, if any. It's only
+	// present in the export when it has been exported with media.
+	Attachment string
+}
+
+// exportLineRegex matches the first line of a message in both Android
+// ("31/12/2019, 23:59 - Name: message") and iOS ("[31/12/2019, 23:59:59]
+// Name: message") exports, in their various locales.
+var exportLineRegex = regexp.MustCompile(
+	`^\[?(\d{1,4})[./-](\d{1,2})[./-](\d{1,4}),? (\d{1,2})[:.](\d{2})(?:[:.](\d{2}))? ?([AaPp]\.? ?[Mm]\.?)?\]?(?: [-–])? (.*)$`,
+)
+
+// androidAttachedSuffixes are the translations of "file attached", which
+// Android exports add after the file name of attached media.
+var androidAttachedSuffixes = []string{
+	"file attached",      // en
+	"bestand bijgevoegd", // nl
+	"Datei angehängt",    // de
+	"archivo adjunto",    // es
+	"fichier joint",      // fr
+	"file allegato",      // it
+	"arquivo anexado",    // pt
+}
+
+var (
+	iosAttachmentRegex     = regexp.MustCompile(`^<attached: (.+)>$`)
+	androidAttachmentRegex = makeAndroidAttachmentRegex()
+)
+
+func makeAndroidAttachmentRegex() *regexp.Regexp {
+	var suffixes []string
+	for _, suffix := range androidAttachedSuffixes {
+		suffixes = append(suffixes, regexp.QuoteMeta(suffix))
+	}
+	return regexp.MustCompile(`^(\S+\.[A-Za-z0-9]+) \((?i:` + strings.Join(suffixes, "|") + `)\)$`)
+}
+
+// exportLineReplacer removes the invisible characters WhatsApp adds to
+// exports, and replaces its special spaces by normal ones.
+var exportLineReplacer = strings.NewReplacer(
+	"\ufeff", "",
+	"\u200e", "",
+	"\u200f", "",
+	"\u202f", " ",
+	"\u00a0", " ",
+	"\r", "",
+)
+
+type exportLine struct {
+	date   [3]int
+	hour   int
+	minute int
+	second int
+	ampm   string
+	rest   string
+	body   []string
+}
+
+// detectDateOrder returns the date order of the given lines, based on the
+// values that can only be days.
+func detectDateOrder(lines []*exportLine) DateOrder {
+	for _, line := range lines {
+		if line.date[0] > 12 {
+			return DateOrderDMY
+		} else if line.date[1] > 12 {
+			return DateOrderMDY
+		}
+	}
+	return DateOrderDMY
+}
+
+func (line *exportLine) time(order DateOrder, loc *time.Location) (time.Time, error) {
+	var year, month, day int
+	switch {
+	case line.date[0] > 31:
+		year, month, day = line.date[0], line.date[1], line.date[2]
+	case order == DateOrderMDY:
+		month, day, year = line.date[0], line.date[1], line.date[2]
+	default:
+		day, month, year = line.date[0], line.date[1], line.date[2]
+	}
+	if year < 100 {
+		year += 2000
+	}
+
+	hour := line.hour
+	switch strings.ToLower(strings.NewReplacer(".", "", " ", "").Replace(line.ampm)) {
+	case "am":
+		if hour == 12 {
+			hour = 0
+		}
+	case "pm":
+		if hour != 12 {
+			hour += 12
+		}
+	}
+
+	if month < 1 || month > 12 || day < 1 || day > 31 || hour > 23 {
+		return time.Time{}, fmt.Errorf("invalid date in export")
+	}
+	return time.Date(year, time.Month(month), day, hour, line.minute, line.second, 0, loc), nil
+}
+
+// ParseWhatsAppExport parses the text file of a chat exported using WhatsApp,
+// with the given date order. Exports contain the local time of the phone they
+// were exported from, which is in the given location.
+// System messages, which have no sender, are skipped.
+func ParseWhatsAppExport(r io.Reader, order DateOrder, loc *time.Location) ([]ImportedMessage, error) {
+	var lines []*exportLine
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		text := exportLineReplacer.Replace(scanner.Text())
+
+		match := exportLineRegex.FindStringSubmatch(text)
+		if match == nil {
+			// continuation of the previous message
+			if len(lines) > 0 {
+				prev := lines[len(lines)-1]
+				prev.body = append(prev.body, text)
+			}
+			continue
+		}
+
+		line := &exportLine{
+			ampm: match[7],
+			rest: match[8],
+		}
+		for i := 0; i < 3; i++ {
+			line.date[i], _ = strconv.Atoi(match[i+1])
+		}
+		line.hour, _ = strconv.Atoi(match[4])
+		line.minute, _ = strconv.Atoi(match[5])
+		if match[6] != "" {
+			line.second, _ = strconv.Atoi(match[6])
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if order == DateOrderAuto {
+		order = detectDateOrder(lines)
+	}
+
+	var res []ImportedMessage
+	for _, line := range lines {
+		i := strings.Index(line.rest, ": ")
+		if i == -1 {
+			continue // system message
+		}
+
+		t, err := line.time(order, loc)
+		if err != nil {
+			return nil, err
+		}
+
+		msg := ImportedMessage{
+			Time:   t,
+			Sender: line.rest[:i],
+		}
+
+		first := strings.TrimSpace(line.rest[i+2:])
+		if match := iosAttachmentRegex.FindStringSubmatch(first); match != nil {
+			msg.Attachment = match[1]
+			first = ""
+		} else if match := androidAttachmentRegex.FindStringSubmatch(first); match != nil {
+			msg.Attachment = match[1]
+			first = ""
+		}
+
+		body := append([]string{first}, line.body...)
+		msg.Body = strings.TrimSpace(strings.Join(body, "\n"))
+
+		res = append(res, msg)
+	}
+
+	return res, nil
+}
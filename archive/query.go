@@ -0,0 +1,65 @@
+package archive
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const dateFormat = "2006-01-02"
+
+// A Query filters archived messages.
+type Query struct {
+	// Terms are the words that should all be present in the body or sender of
+	// a message, case insensitively.
+	Terms []string
+	// Since and Until limit the time the message has been sent, a zero value
+	// means no limit.
+	Since time.Time
+	Until time.Time
+}
+
+// ParseQuery parses the given words into a query. Words of the form
+// since:YYYY-MM-DD and until:YYYY-MM-DD (both inclusive) set the date range,
+// the other words are search terms.
+func ParseQuery(words []string) (Query, error) {
+	var res Query
+
+	for _, word := range words {
+		var err error
+		switch {
+		case strings.HasPrefix(word, "since:"):
+			res.Since, err = time.ParseInLocation(dateFormat, word[len("since:"):], time.Local)
+		case strings.HasPrefix(word, "until:"):
+			res.Until, err = time.ParseInLocation(dateFormat, word[len("until:"):], time.Local)
+			res.Until = res.Until.AddDate(0, 0, 1)
+
+		default:
+			res.Terms = append(res.Terms, strings.ToLower(word))
+		}
+
+		if err != nil {
+			return Query{}, fmt.Errorf("invalid date in %s, expected YYYY-MM-DD", word)
+		}
+	}
+
+	return res, nil
+}
+
+// Matches returns whether or not the given message matches the current query.
+func (q Query) Matches(msg Message) bool {
+	t := msg.Time()
+	if !q.Since.IsZero() && t.Before(q.Since) {
+		return false
+	} else if !q.Until.IsZero() && !t.Before(q.Until) {
+		return false
+	}
+
+	text := strings.ToLower(msg.Sender + " " + msg.Body)
+	for _, term := range q.Terms {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	return true
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
-	"log"
 	"time"
+	"whapp-irc/logger"
 	"whapp-irc/whapp"
 )
 
@@ -15,6 +15,7 @@ type Bridge struct {
 	started bool
 	ctx     context.Context
 	cancel  context.CancelFunc
+	log     *logger.Logger
 }
 
 // MakeBridge makes and returns a new Bridge instance.
@@ -24,24 +25,29 @@ func MakeBridge() *Bridge {
 	}
 }
 
-// Start starts the current bridge instance.
-func (b *Bridge) Start() (started bool, err error) {
+// Start starts the current bridge instance, which logs to log. The instance is
+// stopped when the given context is done.
+func (b *Bridge) Start(ctx context.Context, log *logger.Logger) (started bool, err error) {
 	if b.started {
 		return false, nil
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 
-	wi, err := whapp.MakeInstanceWithPool(ctx, pool, true, loggingLevel)
+	wi, err := whapp.MakeInstanceWithPool(ctx, pool, browserHeadless, log)
 	if err != nil {
 		cancel()
 		return false, err
 	}
 
+	browserInstances.Inc()
+	log.Infof("started browser instance")
+
 	b.started = true
 	b.WI = wi
 	b.ctx = ctx
 	b.cancel = cancel
+	b.log = log
 
 	return true, nil
 }
@@ -55,16 +61,19 @@ func (b *Bridge) Stop() (stopped bool) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	if err := b.WI.Shutdown(ctx); err != nil {
 		// TODO: how do we handle this?
-		log.Printf("error while shutting down: %s", err.Error())
+		b.log.Errorf("error while shutting down: %s", err)
 	}
 
 	b.cancel()
 	cancel()
+	browserInstances.Dec()
+	b.log.Infof("stopped browser instance")
 
 	b.started = false
 	b.WI = nil
 	b.ctx = nil
 	b.cancel = nil
+	b.log = nil
 
 	return true
 }
@@ -0,0 +1,126 @@
+package chatLog
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"whapp-irc/database/lockmap"
+)
+
+const fileExtension = ".weechatlog"
+
+// A Logger writes the messages of every chat of every user to a log file per
+// chat, in the format used by WeeChat: a line per message containing the time,
+// sender and message separated by tabs.
+// Files larger than maxSize are rotated, keeping at most keep old files.
+type Logger struct {
+	Folder string
+
+	retentionMutex sync.RWMutex
+	maxSize        int64
+	keep           int
+
+	lockMap *lockmap.LockMap
+}
+
+// MakeLogger returns a new Logger storing its files in the given folder.
+func MakeLogger(folder string, maxSize int64, keep int) (*Logger, error) {
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return nil, err
+	}
+
+	return &Logger{
+		Folder: folder,
+
+		maxSize: maxSize,
+		keep:    keep,
+
+		lockMap: lockmap.New(),
+	}, nil
+}
+
+// SetRetention sets the size after which log files are rotated, and the amount
+// of rotated files to keep.
+func (l *Logger) SetRetention(maxSize int64, keep int) {
+	l.retentionMutex.Lock()
+	defer l.retentionMutex.Unlock()
+
+	l.maxSize = maxSize
+	l.keep = keep
+}
+
+func (l *Logger) getPath(user, chat string) string {
+	return filepath.Join(
+		l.Folder,
+		url.PathEscape(user),
+		url.PathEscape(strings.ToLower(chat))+fileExtension,
+	)
+}
+
+// rotate rotates the log file at the given path if it's larger than maxSize.
+func (l *Logger) rotate(path string) error {
+	l.retentionMutex.RLock()
+	maxSize, keep := l.maxSize, l.keep
+	l.retentionMutex.RUnlock()
+
+	if maxSize <= 0 {
+		return nil
+	}
+
+	stat, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if stat.Size() < maxSize {
+		return nil
+	}
+
+	if keep <= 0 {
+		return os.Remove(path)
+	}
+
+	// path.(keep-1) -> path.keep, ..., path -> path.1
+	for i := keep - 1; i >= 0; i-- {
+		src := path
+		if i > 0 {
+			src = fmt.Sprintf("%s.%d", path, i)
+		}
+
+		err := os.Rename(src, fmt.Sprintf("%s.%d", path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Log writes the given line sent by from at the given time to the log of the
+// given chat of the given user.
+func (l *Logger) Log(user, chat string, t time.Time, from, line string) error {
+	path := l.getPath(user, chat)
+	unlock := l.lockMap.Lock(path)
+	defer unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := l.rotate(path); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f, "%s\t%s\t%s\n", t.Format("2006-01-02 15:04:05"), from, line)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
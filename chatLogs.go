@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// logMessage writes the given line sent by from to to at the given time to the
+// process log and, if enabled, to the chat logs of the current user.
+func (conn *Connection) logMessage(t time.Time, from, to, line string) {
+	conn.irc.LogMessage(t, from, to, line)
+
+	if chatLogger == nil || !conn.settings().ChatLogs {
+		return
+	}
+
+	// private messages are logged in the chat with the other party.
+	chat := to
+	if strings.EqualFold(to, conn.irc.Nick()) {
+		chat = from
+	}
+
+	if err := chatLogger.Log(conn.irc.Nick(), chat, t, from, line); err != nil {
+		conn.log().With("chat", chat).Errorf("error while writing chat log: %s", err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"whapp-irc/archive"
+	"whapp-irc/config"
+	"whapp-irc/database"
+	"whapp-irc/files"
+	"whapp-irc/logger"
+)
+
+// userBucket is the name of the bucket in which users are stored, for storage
+// backends supporting buckets.
+const userBucket = "users"
+
+// legacyUserFolder is the folder in which users were stored before the
+// storage backend was configurable.
+const legacyUserFolder = "db/users"
+
+// runCommand runs the command given as command line arguments, if any, and
+// returns whether or not a command was run.
+func runCommand(args []string, config config.Config) (ran bool, err error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+
+	switch args[0] {
+	case "migrate-db":
+		src := legacyUserFolder
+		if len(args) > 1 {
+			src = args[1]
+		}
+		return true, migrateDatabase(src, config)
+
+	case "import":
+		if len(args) < 4 {
+			return true, fmt.Errorf("usage: import <user> <chat> <export.txt|export.zip> [me:<name>] [order:dmy|mdy] [tz:<zone>]")
+		}
+		return true, importCommand(args[1], args[2], args[3], args[4:], config)
+
+	case "export":
+		if len(args) < 4 {
+			return true, fmt.Errorf("usage: export <user> <chat> <json|text|html> [since:YYYY-MM-DD] [until:YYYY-MM-DD]")
+		}
+		return true, exportCommand(args[1], args[2], args[3], args[4:], config)
+
+	default:
+		return true, fmt.Errorf("unknown command %s", args[0])
+	}
+}
+
+// migrateDatabase imports all users stored as JSON files in the given folder
+// into the configured database.
+func migrateDatabase(folder string, config config.Config) error {
+	if config.DatabaseBackend == "json" && config.DatabasePath == folder {
+		return fmt.Errorf("source and destination database are the same")
+	}
+
+	src, err := database.MakeFileStorage(folder)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := database.OpenStorage(
+		config.DatabaseBackend,
+		config.DatabasePath,
+		userBucket,
+	)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	n, err := database.Migrate(dst, src)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "migrated %d %s from %s to %s\n", n, plural(n, "user", "users"), folder, config.DatabasePath)
+	return nil
+}
+
+// openCommandState opens the user database, message archive and file server
+// used by commands, and returns a function to close them.
+// The file server isn't started, it's only used to store files and get their
+// URLs.
+func openCommandState(config config.Config) (close func(), err error) {
+	userStorage, err = database.OpenStorage(
+		config.DatabaseBackend,
+		config.DatabasePath,
+		userBucket,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ArchiveMessages {
+		messageArchive, err = archive.MakeArchive(config.ArchivePath)
+		if err != nil {
+			userStorage.Close()
+			return nil, err
+		}
+	}
+
+	fs, err = files.MakeFileServer(
+		config.FileServerHost,
+		config.FileServerPort,
+		"files",
+		config.FileServerHTTPS,
+		logger.Default().With("component", "fileserver"),
+	)
+	if err != nil {
+		userStorage.Close()
+		return nil, err
+	}
+
+	return func() { userStorage.Close() }, nil
+}
+
+// exportCommand writes the archived messages of the given user in the given
+// chat to stdout in the given format.
+func exportCommand(user, chat, format string, words []string, config config.Config) error {
+	query, err := archive.ParseQuery(words)
+	if err != nil {
+		return err
+	}
+
+	close, err := openCommandState(config)
+	if err != nil {
+		return err
+	}
+	defer close()
+
+	return exportArchive(os.Stdout, user, chat, format, query)
+}
+
+// importCommand imports the chat exported using WhatsApp at the given path
+// into the archive of the given user. options are me:<name>, the name of the
+// user in the export, order:<dmy|mdy>, the order of dates in the export, and
+// tz:<zone>, the time zone of the phone the chat was exported from.
+// It refuses to run while whapp-irc is running, since the server doesn't
+// expect others to change its data.
+func importCommand(user, chat, path string, options []string, config config.Config) error {
+	var me string
+	order := archive.DateOrderAuto
+	loc := time.Local
+	for _, option := range options {
+		switch {
+		case strings.HasPrefix(option, "me:"):
+			me = option[len("me:"):]
+		case strings.HasPrefix(option, "tz:"):
+			var err error
+			if loc, err = time.LoadLocation(option[len("tz:"):]); err != nil {
+				return err
+			}
+		case option == "order:dmy":
+			order = archive.DateOrderDMY
+		case option == "order:mdy":
+			order = archive.DateOrderMDY
+
+		default:
+			return fmt.Errorf("unknown option %s", option)
+		}
+	}
+
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	close, err := openCommandState(config)
+	if err != nil {
+		return err
+	}
+	defer close()
+
+	zone, _ := time.Now().In(loc).Zone()
+	fmt.Fprintf(os.Stderr, "reading the times in the export as %s (%s), use tz:<zone> for another time zone\n", loc, zone)
+	n, err := importChat(user, chat, path, me, order, loc)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "imported %d %s into %s\n", n, plural(n, "message", "messages"), chat)
+	return nil
+}
@@ -1,10 +1,14 @@
 package config
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"whapp-irc/logger"
 	"whapp-irc/maps"
 	"whapp-irc/whapp"
 )
@@ -16,73 +20,340 @@ type Config struct {
 	FileServerHTTPS bool
 
 	IRCPort string
+	IRCMOTD string
 
-	LoggingLevel whapp.LoggingLevel
+	AdminHost string
+	AdminPort string
 
-	MapProvider maps.Provider
+	BrowserHeadless bool
 
-	AlternativeReplay bool
+	LogLevel      logger.Level
+	LogFormat     logger.Format
+	LogCDPTraffic bool
+	LogIRCTraffic bool
+
+	FFmpegPath string
+
+	MediaDownloadOptions whapp.DownloadOptions
+
+	DatabaseBackend string
+	DatabasePath    string
+	DatabaseSecret  string
+
+	ArchiveMessages bool
+	ArchivePath     string
+
+	LogMessageContents bool
+	ChatLogPath        string
+	ChatLogMaxSize     int64
+	ChatLogKeep        int
+
+	Users Users
+
+	// File is the path of the config file used, if any.
+	File string
+	// CheckOnly is set when whapp-irc should only check the configuration.
+	CheckOnly bool
+}
+
+// UserSettings contains the options which can be set per user.
+type UserSettings struct {
+	MapProvider         maps.Provider
+	AlternativeReplay   bool
+	TranscodeVoiceNotes bool
+	ChatLogs            bool
+}
+
+// Users contains the default settings for users, and the settings of specific
+// users.
+type Users struct {
+	Defaults UserSettings
+	ByNick   map[string]UserSettings
+}
+
+// Get returns the settings of the user with the given nick.
+func (u Users) Get(nick string) UserSettings {
+	if settings, has := u.ByNick[strings.ToLower(nick)]; has {
+		return settings
+	}
+	return u.Defaults
+}
+
+// optionFlag is a command line flag setting the value of an option.
+type optionFlag struct {
+	option option
+	values map[string]value
 }
 
-func getEnvDefault(env, def string) string {
-	res := os.Getenv(env)
-	if res == "" {
-		return def
+func (f optionFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return f.values[f.option.name()].str
+}
+
+func (f optionFlag) Set(str string) error {
+	f.values[f.option.name()] = value{
+		str:    str,
+		source: "flag -" + f.option.flagName(),
+	}
+	return nil
+}
+
+func (f optionFlag) IsBoolFlag() bool {
+	return f.option.kind == kindBool
+}
+
+// parser converts the values of options, collecting the errors.
+type parser struct {
+	values map[string]value
+	errs   []string
+}
+
+func (p *parser) fail(name string, v value, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	err := fmt.Sprintf("%s: %s: invalid value %q: %s", v.source, name, v.str, msg)
+
+	// values shared by multiple users are parsed multiple times.
+	for _, e := range p.errs {
+		if e == err {
+			return
+		}
+	}
+	p.errs = append(p.errs, err)
+}
+
+func (p *parser) value(section, key string) (string, value) {
+	name := section + "." + key
+	return name, p.values[name]
+}
+
+func (p *parser) string(section, key string) string {
+	_, v := p.value(section, key)
+	return v.str
+}
+
+func (p *parser) bool(section, key string) bool {
+	name, v := p.value(section, key)
+	res, err := strconv.ParseBool(v.str)
+	if err != nil {
+		p.fail(name, v, "expected true or false")
 	}
 	return res
 }
 
-// ReadEnvVars reads environment variables and returns a Config instance
-// containing the parsed values, or an error.
-func ReadEnvVars() (Config, error) {
-	host := getEnvDefault("HOST", "localhost")
-	fileServerPort := getEnvDefault("FILE_SERVER_PORT", "3000")
-	fileServerUseHTTPS := getEnvDefault("FILE_SERVER_HTTPS", "false")
-	ircPort := getEnvDefault("IRC_SERVER_PORT", "6060")
-	logLevelRaw := getEnvDefault("LOG_LEVEL", "normal")
-	mapProviderRaw := getEnvDefault("MAP_PROVIDER", "google-maps")
-	replayMode := getEnvDefault("REPLAY_MODE", "normal")
+func (p *parser) int(section, key string) int64 {
+	name, v := p.value(section, key)
+	res, err := strconv.ParseInt(v.str, 10, 64)
+	if err != nil {
+		p.fail(name, v, "expected an integer")
+	} else if res < 0 {
+		p.fail(name, v, "can't be negative")
+	}
+	return res
+}
 
-	useHTTPS, err := strconv.ParseBool(fileServerUseHTTPS)
+func (p *parser) duration(section, key string) time.Duration {
+	name, v := p.value(section, key)
+	res, err := time.ParseDuration(v.str)
 	if err != nil {
-		return Config{}, err
+		p.fail(name, v, "expected a duration, like 30s or 5m")
 	}
+	return res
+}
+
+func (p *parser) choice(section, key string, choices map[string]int) int {
+	name, v := p.value(section, key)
+	res, has := choices[strings.ToLower(v.str)]
+	if !has {
+		var names []string
+		for choice := range choices {
+			names = append(names, choice)
+		}
+		sort.Strings(names)
+		p.fail(name, v, "expected one of %s", strings.Join(names, ", "))
+	}
+	return res
+}
 
-	var logLevel whapp.LoggingLevel
-	switch strings.ToLower(logLevelRaw) {
-	case "verbose":
-		logLevel = whapp.LogLevelVerbose
-	case "normal":
-		logLevel = whapp.LogLevelNormal
+func (p *parser) userSettings() UserSettings {
+	mapProvider := p.choice(userSection, "map_provider", map[string]int{
+		"google-maps":     int(maps.GoogleMaps),
+		"googlemaps":      int(maps.GoogleMaps),
+		"openstreetmap":   int(maps.OpenStreetMap),
+		"open-street-map": int(maps.OpenStreetMap),
+	})
+	replayMode := p.choice(userSection, "replay_mode", map[string]int{
+		"normal":      0,
+		"alternative": 1,
+	})
 
-	default:
-		err := fmt.Errorf("no log level %s found", logLevelRaw)
-		return Config{}, err
+	return UserSettings{
+		MapProvider:         maps.Provider(mapProvider),
+		AlternativeReplay:   replayMode == 1,
+		TranscodeVoiceNotes: p.bool(userSection, "transcode_voice_notes"),
+		ChatLogs:            p.bool(userSection, "chat_logs"),
+	}
+}
+
+func (p *parser) config() Config {
+	// normal and verbose are the levels of older versions, verbose also logged
+	// all communication with chromium.
+	const logLevelVerbose = -1
+	logLevel := p.choice("logging", "level", map[string]int{
+		"debug":   int(logger.LevelDebug),
+		"info":    int(logger.LevelInfo),
+		"warning": int(logger.LevelWarning),
+		"error":   int(logger.LevelError),
+		"normal":  int(logger.LevelInfo),
+		"verbose": logLevelVerbose,
+	})
+	logCDPTraffic := p.bool("logging", "cdp_traffic")
+	if logLevel == logLevelVerbose {
+		logLevel = int(logger.LevelDebug)
+		logCDPTraffic = true
 	}
 
-	var mapProvider maps.Provider
-	switch strings.ToLower(mapProviderRaw) {
-	case "openstreetmap", "open-street-map":
-		mapProvider = maps.OpenStreetMap
-	case "googlemaps", "google-maps":
-		mapProvider = maps.GoogleMaps
+	backend := strings.ToLower(p.string("storage", "backend"))
+	databasePath := p.string("storage", "path")
+	switch backend {
+	case "json":
+		if databasePath == "" {
+			databasePath = "db/users"
+		}
+	case "bolt":
+		if databasePath == "" {
+			databasePath = "db/whapp-irc.db"
+		}
 
 	default:
-		err := fmt.Errorf("no map provider %s found", mapProviderRaw)
-		return Config{}, err
+		name, v := p.value("storage", "backend")
+		p.fail(name, v, "expected json or bolt")
 	}
 
 	return Config{
-		FileServerHost:  host,
-		FileServerPort:  fileServerPort,
-		FileServerHTTPS: useHTTPS,
+		FileServerHost:  p.string("fileserver", "host"),
+		FileServerPort:  p.string("fileserver", "port"),
+		FileServerHTTPS: p.bool("fileserver", "https"),
+
+		IRCPort: p.string("irc", "port"),
+		IRCMOTD: p.string("irc", "motd"),
+
+		AdminHost: p.string("admin", "host"),
+		AdminPort: p.string("admin", "port"),
+
+		BrowserHeadless: p.bool("browser", "headless"),
+
+		LogLevel: logger.Level(logLevel),
+		LogFormat: logger.Format(p.choice("logging", "format", map[string]int{
+			"text": int(logger.FormatText),
+			"json": int(logger.FormatJSON),
+		})),
+		LogCDPTraffic: logCDPTraffic,
+		LogIRCTraffic: p.bool("logging", "irc_traffic"),
+
+		FFmpegPath: p.string("media", "ffmpeg_path"),
+
+		MediaDownloadOptions: whapp.DownloadOptions{
+			MaxSize: p.int("media", "max_size_mb") * 1024 * 1024,
+			Timeout: p.duration("media", "download_timeout"),
+			Retries: int(p.int("media", "download_retries")),
+		},
+
+		DatabaseBackend: backend,
+		DatabasePath:    databasePath,
+		DatabaseSecret:  p.string("storage", "secret"),
+
+		ArchiveMessages: p.bool("storage", "archive"),
+		ArchivePath:     p.string("storage", "archive_path"),
+
+		LogMessageContents: p.bool("logging", "message_contents"),
+		ChatLogPath:        p.string("logging", "chat_log_path"),
+		ChatLogMaxSize:     p.int("logging", "chat_log_max_size_mb") * 1024 * 1024,
+		ChatLogKeep:        int(p.int("logging", "chat_log_keep")),
 
-		IRCPort: ircPort,
+		Users: Users{
+			Defaults: p.userSettings(),
+		},
+	}
+}
+
+// Load reads the configuration from the config file, environment variables and
+// the given command line arguments, in increasing order of precedence.
+// Settings of specific users in the config file override the defaults for
+// users. It returns the parsed configuration and the remaining arguments.
+func Load(args []string) (Config, []string, error) {
+	flags := flag.NewFlagSet("whapp-irc", flag.ContinueOnError)
+	file := flags.String("config", os.Getenv("CONFIG_FILE"), "the path of the config file")
+	checkOnly := flags.Bool("check-config", false, "only check the configuration and exit")
+
+	flagValues := make(map[string]value)
+	for _, o := range options {
+		usage := fmt.Sprintf("%s (%s)", o.usage, o.env)
+		flags.Var(optionFlag{o, flagValues}, o.flagName(), usage)
+	}
 
-		LoggingLevel: logLevel,
+	if err := flags.Parse(args); err != nil {
+		return Config{}, nil, err
+	}
+
+	values := make(map[string]value)
+	for _, o := range options {
+		values[o.name()] = value{str: o.def, source: "default"}
+	}
 
-		MapProvider: mapProvider,
+	var users map[string]map[string]value
+	if *file != "" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return Config{}, nil, err
+		}
+		fv, err := parseFile(*file, f)
+		f.Close()
+		if err != nil {
+			return Config{}, nil, err
+		}
+
+		for name, v := range fv.values {
+			values[name] = v
+		}
+		users = fv.users
+	}
+
+	for _, o := range options {
+		// an empty variable is used as well, to unset a value from the file.
+		if str, has := os.LookupEnv(o.env); has {
+			values[o.name()] = value{
+				str:    str,
+				source: "environment variable " + o.env,
+			}
+		}
+	}
+	for name, v := range flagValues {
+		values[name] = v
+	}
+
+	p := &parser{values: values}
+	res := p.config()
+
+	res.Users.ByNick = make(map[string]UserSettings)
+	for nick, userValues := range users {
+		p.values = make(map[string]value)
+		for name, v := range values {
+			p.values[name] = v
+		}
+		for name, v := range userValues {
+			p.values[name] = v
+		}
+
+		res.Users.ByNick[nick] = p.userSettings()
+	}
+
+	if len(p.errs) > 0 {
+		return Config{}, nil, fmt.Errorf("%s", strings.Join(p.errs, "\n"))
+	}
 
-		AlternativeReplay: replayMode == "alternative",
-	}, nil
+	res.File = *file
+	res.CheckOnly = *checkOnly
+	return res, flags.Args(), nil
 }
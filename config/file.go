@@ -0,0 +1,216 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// userSectionPrefix is the prefix of sections containing the settings of a
+// specific user.
+const userSectionPrefix = "users."
+
+var (
+	sectionRegex = regexp.MustCompile(`^\[\s*([A-Za-z0-9_.-]+|users\."[^"]+")\s*\]$`)
+	keyRegex     = regexp.MustCompile(`^([A-Za-z0-9_-]+)\s*=\s*(.*)$`)
+	intRegex     = regexp.MustCompile(`^[+-]?[0-9][0-9_]*$`)
+)
+
+// A value is the value of an option, and where it's set.
+type value struct {
+	str    string
+	source string
+}
+
+// fileValues contains the values set in a config file.
+type fileValues struct {
+	values map[string]value
+	// users contains the values of the per-user options set for specific
+	// users, by nick.
+	users map[string]map[string]value
+}
+
+// parseFileValue parses the given TOML value, which should be of the given
+// kind, and returns it as a string.
+func parseFileValue(raw string, k kind) (string, error) {
+	var res, rest string
+
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		end := 1
+		for ; end < len(raw); end++ {
+			if raw[end] == '\\' {
+				end++
+			} else if raw[end] == '"' {
+				break
+			}
+		}
+		if end >= len(raw) {
+			return "", fmt.Errorf("unterminated string")
+		}
+
+		str, err := strconv.Unquote(raw[:end+1])
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", raw[:end+1])
+		}
+		res, rest = str, raw[end+1:]
+
+	case strings.HasPrefix(raw, "'"):
+		end := strings.IndexByte(raw[1:], '\'')
+		if end == -1 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		res, rest = raw[1:end+1], raw[end+2:]
+
+	default:
+		res = raw
+		if i := strings.IndexByte(raw, '#'); i != -1 {
+			res, rest = raw[:i], raw[i:]
+		}
+		res = strings.TrimSpace(res)
+
+		switch {
+		case res == "true" || res == "false":
+			if k != kindBool {
+				return "", fmt.Errorf("expected %s, got a boolean", k)
+			}
+		case intRegex.MatchString(res):
+			if k != kindInt {
+				return "", fmt.Errorf("expected %s, got an integer", k)
+			}
+			res = strings.Replace(res, "_", "", -1)
+
+		default:
+			return "", fmt.Errorf("invalid value %s", res)
+		}
+	}
+
+	if strings.HasPrefix(raw, `"`) || strings.HasPrefix(raw, "'") {
+		if k != kindString && k != kindDuration {
+			return "", fmt.Errorf("expected %s, got a string", k)
+		}
+	}
+
+	if rest = strings.TrimSpace(rest); rest != "" && rest[0] != '#' {
+		return "", fmt.Errorf("unexpected %s after value", rest)
+	}
+	return res, nil
+}
+
+// parseFile parses the config file with the given name in r. The file is
+// written in a subset of TOML: sections, and keys with string, integer and
+// boolean values.
+func parseFile(name string, r io.Reader) (fileValues, error) {
+	res := fileValues{
+		values: make(map[string]value),
+		users:  make(map[string]map[string]value),
+	}
+
+	var errs []string
+	fail := func(line int, format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		errs = append(errs, fmt.Sprintf("%s:%d: %s", name, line, msg))
+	}
+
+	var section, user string
+	seenSections := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			if i := strings.Index(line, "#"); i != -1 && strings.IndexByte(line, ']') < i {
+				line = strings.TrimSpace(line[:i])
+			}
+
+			match := sectionRegex.FindStringSubmatch(line)
+			if match == nil {
+				fail(lineNo, "invalid section %s", line)
+				section = ""
+				continue
+			}
+
+			section, user = match[1], ""
+			seenName := section
+			if strings.HasPrefix(section, userSectionPrefix) {
+				// nicks are case insensitive, so [users.Alice] and
+				// [users.alice] are the same section.
+				user = strings.ToLower(strings.Trim(section[len(userSectionPrefix):], `"`))
+				if user == "" {
+					fail(lineNo, "empty user name")
+				}
+				seenName = userSectionPrefix + user
+			} else if !hasSection(section) {
+				fail(lineNo, "unknown section [%s]", section)
+				section = ""
+				continue
+			}
+
+			if seenSections[seenName] {
+				fail(lineNo, "duplicate section [%s]", section)
+			}
+			seenSections[seenName] = true
+			continue
+		}
+
+		match := keyRegex.FindStringSubmatch(line)
+		if match == nil {
+			fail(lineNo, "expected key = value, got %s", line)
+			continue
+		} else if section == "" {
+			fail(lineNo, "key %s isn't in a (known) section", match[1])
+			continue
+		}
+
+		key := match[1]
+		optionSection := section
+		if user != "" {
+			optionSection = userSection
+		}
+		o, found := findOption(optionSection, key)
+		if !found {
+			fail(lineNo, "unknown key %s in section [%s]", key, section)
+			continue
+		}
+
+		str, err := parseFileValue(match[2], o.kind)
+		if err != nil {
+			fail(lineNo, "%s: %s", key, err)
+			continue
+		}
+
+		v := value{
+			str:    str,
+			source: fmt.Sprintf("%s:%d", name, lineNo),
+		}
+
+		values := res.values
+		if user != "" {
+			values = res.users[user]
+			if values == nil {
+				values = make(map[string]value)
+				res.users[user] = values
+			}
+		}
+
+		if prev, has := values[o.name()]; has {
+			fail(lineNo, "duplicate key %s, first set at %s", key, prev.source)
+			continue
+		}
+		values[o.name()] = v
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fileValues{}, err
+	} else if len(errs) > 0 {
+		return fileValues{}, fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return res, nil
+}
@@ -0,0 +1,110 @@
+package config
+
+import "strings"
+
+// kind is the type of the value of an option.
+type kind int
+
+const (
+	kindString kind = iota
+	kindBool
+	kindInt
+	kindDuration
+)
+
+func (k kind) String() string {
+	switch k {
+	case kindBool:
+		return "a boolean"
+	case kindInt:
+		return "an integer"
+	case kindDuration:
+		return "a duration string"
+	default:
+		return "a string"
+	}
+}
+
+// An option is a configuration option, which can be set in the config file,
+// using an environment variable and using a command line flag.
+type option struct {
+	section string
+	key     string
+	env     string
+	kind    kind
+	def     string
+	usage   string
+}
+
+// name returns the name of the current option, as section.key.
+func (o option) name() string {
+	return o.section + "." + o.key
+}
+
+// flagName returns the name of the command line flag for the current option.
+func (o option) flagName() string {
+	return o.section + "-" + strings.Replace(o.key, "_", "-", -1)
+}
+
+// userSection is the section containing the default per-user settings, which
+// can be overridden for specific users in [users.<nick>] sections.
+const userSection = "defaults"
+
+var options = []option{
+	{"irc", "port", "IRC_SERVER_PORT", kindString, "6060", "the port to listen on for IRC connections"},
+	{"irc", "motd", "IRC_MOTD", kindString, "Enjoy the ride.", "the message of the day sent to IRC clients"},
+
+	{"fileserver", "host", "HOST", kindString, "localhost", "the host the file server is reachable on"},
+	{"fileserver", "port", "FILE_SERVER_PORT", kindString, "3000", "the port to listen on for the file server"},
+	{"fileserver", "https", "FILE_SERVER_HTTPS", kindBool, "false", "whether the file server is reachable using HTTPS"},
+
+	{"admin", "host", "ADMIN_HOST", kindString, "127.0.0.1", "the address to listen on for the admin HTTP server"},
+	{"admin", "port", "ADMIN_PORT", kindString, "", "the port to listen on for the admin HTTP server, empty disables it"},
+
+	{"browser", "headless", "BROWSER_HEADLESS", kindBool, "true", "whether to run chromium headless"},
+
+	{"media", "max_size_mb", "MEDIA_MAX_SIZE_MB", kindInt, "100", "the maximum size of media to download in megabytes, 0 means no limit"},
+	{"media", "download_timeout", "MEDIA_DOWNLOAD_TIMEOUT", kindDuration, "5m", "the maximum duration of a single media download attempt"},
+	{"media", "download_retries", "MEDIA_DOWNLOAD_RETRIES", kindInt, "3", "the amount of times a failed media download is resumed"},
+	{"media", "ffmpeg_path", "FFMPEG_PATH", kindString, "ffmpeg", "the path to the ffmpeg binary used to transcode voice notes"},
+
+	{"storage", "backend", "DB_BACKEND", kindString, "json", "the storage used for user data: json or bolt"},
+	{"storage", "path", "DB_PATH", kindString, "", "the folder (json) or file (bolt) to store user data in"},
+	{"storage", "secret", "DB_SECRET", kindString, "", "the secret used to encrypt the stored WhatsApp sessions"},
+	{"storage", "archive", "ARCHIVE_MESSAGES", kindBool, "false", "whether to store every bridged message in the archive"},
+	{"storage", "archive_path", "ARCHIVE_PATH", kindString, "db/archive", "the folder to store the message archive in"},
+
+	{"logging", "level", "LOG_LEVEL", kindString, "info", "the minimum level of logged lines: debug, info, warning or error"},
+	{"logging", "format", "LOG_FORMAT", kindString, "text", "the format of the log: text or json"},
+	{"logging", "message_contents", "LOG_MESSAGE_CONTENTS", kindBool, "true", "whether to write the contents of messages to the process log"},
+	{"logging", "cdp_traffic", "LOG_CDP_TRAFFIC", kindBool, "false", "whether to log all communication with chromium"},
+	{"logging", "irc_traffic", "LOG_IRC_TRAFFIC", kindBool, "false", "whether to log all messages sent to and received from IRC clients"},
+	{"logging", "chat_log_path", "CHAT_LOG_PATH", kindString, "logs", "the folder to store the chat logs in"},
+	{"logging", "chat_log_max_size_mb", "CHAT_LOG_MAX_SIZE_MB", kindInt, "10", "the size in megabytes after which a chat log is rotated"},
+	{"logging", "chat_log_keep", "CHAT_LOG_KEEP", kindInt, "5", "the amount of rotated chat logs to keep"},
+
+	{userSection, "map_provider", "MAP_PROVIDER", kindString, "google-maps", "the map provider for location messages: google-maps or openstreetmap"},
+	{userSection, "replay_mode", "REPLAY_MODE", kindString, "normal", "normal or alternative"},
+	{userSection, "transcode_voice_notes", "TRANSCODE_VOICE_NOTES", kindBool, "false", "whether to store voice notes as mp3 as well"},
+	{userSection, "chat_logs", "CHAT_LOGS", kindBool, "false", "whether to log messages to a file per chat"},
+}
+
+// findOption returns the option with the given key in the given section.
+func findOption(section, key string) (option, bool) {
+	for _, o := range options {
+		if o.section == section && o.key == key {
+			return o, true
+		}
+	}
+	return option{}, false
+}
+
+// hasSection returns whether or not a section with the given name exists.
+func hasSection(section string) bool {
+	for _, o := range options {
+		if o.section == section {
+			return true
+		}
+	}
+	return false
+}
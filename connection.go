@@ -2,22 +2,30 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"io"
-	"log"
-	"math"
 	"net"
 	"strings"
 	"sync"
 	"time"
+	"whapp-irc/database"
 	"whapp-irc/ircConnection"
+	"whapp-irc/logger"
 	"whapp-irc/whapp"
+
+	"gopkg.in/sorcix/irc.v2"
 )
 
 // queue up to ten irc messages, this is especially helpful to answer PINGs in
 // time, and during connection setup.
 const ircMessageQueueSize = 10
 
+// download up to four files at the same time per connection.
+const mediaDownloadConcurrency = 4
+
+// save the user state at most once every five seconds.
+const persistInterval = 5 * time.Second
+
 type ChatListItem struct {
 	Identifier string   `json:"identifier"`
 	ID         whapp.ID `json:"id"`
@@ -25,6 +33,51 @@ type ChatListItem struct {
 	chat *Chat
 }
 
+// storedChatListItem is the layout of a ChatListItem in the database.
+type storedChatListItem struct {
+	Identifier string `json:"identifier"`
+	ID         string `json:"id"`
+}
+
+// MarshalJSON encodes the ID of the current item as user@server, so that the
+// stored layout doesn't depend on the layout of whapp.ID.
+func (item ChatListItem) MarshalJSON() ([]byte, error) {
+	return json.Marshal(storedChatListItem{
+		Identifier: item.Identifier,
+		ID:         item.ID.String(),
+	})
+}
+
+// UnmarshalJSON decodes an item encoded using MarshalJSON.
+func (item *ChatListItem) UnmarshalJSON(bytes []byte) error {
+	var stored storedChatListItem
+	if err := json.Unmarshal(bytes, &stored); err != nil {
+		return err
+	}
+
+	id, err := parseStoredID(stored.ID)
+	if err != nil {
+		return err
+	}
+
+	item.Identifier = stored.Identifier
+	item.ID = id
+	return nil
+}
+
+// parseStoredID parses an ID stored as user@server.
+func parseStoredID(str string) (whapp.ID, error) {
+	i := strings.LastIndex(str, "@")
+	if i == -1 {
+		return whapp.ID{}, fmt.Errorf("invalid stored ID %s", str)
+	}
+
+	return whapp.ID{
+		User:   str[:i],
+		Server: str[i+1:],
+	}, nil
+}
+
 // A Connection represents an IRC connection.
 type Connection struct {
 	bridge *Bridge
@@ -32,12 +85,29 @@ type Connection struct {
 	irc *ircConnection.IRCConnection
 
 	timestampMap *TimestampMap
+	messageIDs   *MessageIDMap
+
+	media     *MediaQueue
+	persister *Persister
+	health    *SessionHealth
+	session   *SessionState
+	login     *LoginCodes
+
+	// db stores the user, encrypted if encrypted is true.
+	db        *database.Database
+	encrypted bool
 
 	me           whapp.Me
 	localStorage map[string]string
 
-	m     sync.RWMutex
-	chats []ChatListItem
+	m           sync.RWMutex
+	chats       []ChatListItem
+	stateLoaded bool
+}
+
+// log returns the logger of the current connection.
+func (conn *Connection) log() *logger.Logger {
+	return conn.irc.Log()
 }
 
 // BindSocket binds the given TCP connection.
@@ -48,12 +118,26 @@ func BindSocket(socket *net.TCPConn) error {
 	conn := &Connection{
 		bridge: MakeBridge(),
 
-		irc: ircConnection.HandleConnection(ctx, socket),
+		irc: ircConnection.HandleConnection(ctx, socket, logger.Default()),
 
 		timestampMap: MakeTimestampMap(),
+		messageIDs:   MakeMessageIDMap(messageIDListSize),
+
+		health:  MakeSessionHealth(),
+		session: MakeSessionState(),
+		login:   MakeLoginCodes(),
+	}
+
+	if !connections.Add(conn, cancel) {
+		conn.sendShutdownNotice()
+		conn.irc.Close()
+		return nil
 	}
 
+	stopped := make(chan struct{})
 	go func() {
+		defer close(stopped)
+
 		select {
 		case <-conn.irc.StopChannel():
 		case <-ctx.Done():
@@ -63,7 +147,11 @@ func BindSocket(socket *net.TCPConn) error {
 		// everything off
 		cancel()
 		conn.irc.Close()
-		conn.bridge.Stop()
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+		connections.Remove(conn)
 	}()
 
 	// wait for the client to send a nickname
@@ -73,190 +161,63 @@ func BindSocket(socket *net.TCPConn) error {
 	case <-conn.irc.NickSetChannel():
 	}
 
-	// send the welcome message to the user and setup the bridge.
-	if err := func() error {
-		if err := conn.irc.WriteListNow([]string{
-			fmt.Sprintf(":whapp-irc 001 %s :Welcome to whapp-irc, %s.", conn.irc.Nick(), conn.irc.Nick()),
-			fmt.Sprintf(":whapp-irc 002 %s :Your host is whapp-irc.", conn.irc.Nick()),
-			fmt.Sprintf(":whapp-irc 003 %s :This server was created %s.", conn.irc.Nick(), startTime),
-			fmt.Sprintf(":whapp-irc 004 %s :", conn.irc.Nick()),
-			fmt.Sprintf(":whapp-irc 005 %s PREFIX=(qo)~@ CHARSET=UTF-8 :are supported by this server", conn.irc.Nick()),
-			fmt.Sprintf(":whapp-irc 375 %s :The server is running on commit %s", conn.irc.Nick(), commit),
-			fmt.Sprintf(":whapp-irc 372 %s :Enjoy the ride.", conn.irc.Nick()),
-			fmt.Sprintf(":whapp-irc 376 %s :End of /MOTD command.", conn.irc.Nick()),
-		}); err != nil {
-			return err
-		}
-
-		if err := conn.setup(cancel); err != nil {
-			log.Printf("err while setting up: %s\n", err.Error())
-			return err
-		}
-
-		return nil
-	}(); err != nil {
-		conn.irc.Status("erroring setting up whapp bridge: " + err.Error())
+	db, encrypted, err := makeUserDb(conn.irc.Nick(), conn.irc.Password())
+	if err != nil {
 		return err
 	}
-
-	// now that we have set-up the bridge...
-
-	// actually handle most of the IRC messages
-	go func() {
-		defer cancel()
-		ircReceiveCh := conn.irc.ReceiveChannel()
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-
-			case msg, ok := <-ircReceiveCh:
-				if !ok {
-					return
-				}
-
-				if err := conn.handleIRCCommand(msg); err != nil {
-					log.Printf("error handling new irc message: %s\n", err)
-
-					if err == io.ErrClosedPipe {
-						return
-					}
-					continue
-				}
-			}
-		}
+	conn.db = db
+	conn.encrypted = encrypted
+
+	conn.media = MakeMediaQueue(
+		ctx,
+		conn.irc.Nick(),
+		conn.log(),
+		mediaDownloadConcurrency,
+	)
+
+	// the user state is saved by a single goroutine, which saves it one last
+	// time when the connection ends.
+	conn.persister = MakePersister(conn.saveDatabaseEntry, persistInterval)
+	go conn.persister.Run(ctx)
+	defer func() {
+		cancel()
+		<-conn.persister.Done()
 	}()
 
-	// we want to wait until we've finished negotiation, since when we send a
-	// replay we want to know if the user has servertime and even if they want a
-	// replay at all.
-	// if negotiation hasn't started yet, we just skip through (we figure the
-	// client doesn't support IRCv3, since normally negotiation occurs fairly
-	// early in the connection)
-	started, ok := conn.irc.Caps.WaitNegotiation(ctx)
-	if !ok {
-		return nil
-	} else if !started {
-		str := "IRCv3 capabilities negotiation has not started, " +
-			"this is probably a non IRCv3 compatible client."
-		log.Printf(str)
+	// send the welcome message to the user.
+	if err := conn.irc.WriteListNow([]string{
+		fmt.Sprintf(":whapp-irc 001 %s :Welcome to whapp-irc, %s.", conn.irc.Nick(), conn.irc.Nick()),
+		fmt.Sprintf(":whapp-irc 002 %s :Your host is whapp-irc.", conn.irc.Nick()),
+		fmt.Sprintf(":whapp-irc 003 %s :This server was created %s.", conn.irc.Nick(), startTime),
+		fmt.Sprintf(":whapp-irc 004 %s :", conn.irc.Nick()),
+		fmt.Sprintf(":whapp-irc 005 %s PREFIX=(qo)~@ CHARSET=UTF-8 :are supported by this server", conn.irc.Nick()),
+	}); err != nil {
+		return err
 	}
-
-	// replay older messages
-	empty := conn.timestampMap.Length() == 0
-	for _, item := range conn.chats {
-		c := item.chat
-
-		prevTimestamp, found := conn.timestampMap.Get(c.ID.String())
-
-		if empty || !conn.hasReplay() {
-			conn.timestampMap.Set(c.ID.String(), c.rawChat.Timestamp)
-			go conn.saveDatabaseEntry()
-			continue
-		} else if c.rawChat.Timestamp <= prevTimestamp {
-			continue
-		}
-
-		if !found {
-			// fetch all older messages
-			prevTimestamp = math.MinInt64
-		}
-
-		messages, err := c.rawChat.GetMessagesFromChatTillDate(
-			conn.bridge.ctx,
-			conn.bridge.WI,
-			prevTimestamp,
-		)
-		if err != nil {
-			log.Printf("error while loading earlier messages: %s\n", err.Error())
-			return err
-		}
-
-		for _, msg := range messages {
-			if msg.Timestamp <= prevTimestamp {
-				continue
-			}
-
-			if err := conn.handleWhappMessageReplay(msg); err != nil {
-				log.Printf("error handling older whapp message: %s\n", err.Error())
-				continue
-			}
-		}
+	if err := conn.sendMOTD(); err != nil {
+		return err
 	}
 
-	conn.irc.Status("ready for new messages")
-
-	// handle logging out on whatsapp web, this happens when the user removes
-	// the bridge client on their phone.
-	go func() {
-		defer cancel()
-
-		resCh, errCh := conn.bridge.WI.ListenLoggedIn(conn.bridge.ctx, time.Second)
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-
-			case err := <-errCh:
-				log.Printf("error while listening for whatsapp loggedin state: %s\n", err.Error())
-				return
-
-			case res := <-resCh:
-				if res {
-					continue
-				}
-
-				conn.irc.Status("logged out of whatsapp")
-
-				return
-			}
-		}
-	}()
+	// handle the IRC messages, messages which need WhatsApp are queued until
+	// a session is set up.
+	sessionMessages := make(chan *irc.Message, ircMessageQueueSize)
+	go conn.handleIRCMessages(ctx, cancel, conn.irc.ReceiveChannel(), func(msg *irc.Message) error {
+		return conn.handleIRCCommand(ctx, msg, sessionMessages)
+	})
+	go conn.handleIRCMessages(ctx, cancel, sessionMessages, func(msg *irc.Message) error {
+		return conn.waitSession(ctx, func() error {
+			return conn.handleSessionCommand(msg)
+		})
+	})
 
-	// listen for new WhatsApp messages
-	go func() {
-		defer cancel()
-
-		// REVIEW: we use other `ctx`s here, is that correct?
-		// TODO: It looks like we should have to restart this, a bridge should
-		// have closer grasp of whatever messages should be sent. Currently a
-		// bridge is loosly defined of whatever it does. The struct itself
-		// should provide more functions, and we should do less. In a prefect
-		// world, WI isn't exposed.
-		messageCh, errCh := conn.bridge.WI.ListenForMessages(
-			conn.bridge.ctx,
-			500*time.Millisecond,
-		)
-		queue := GetMessageQueue(ctx, messageCh, 50)
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-
-			case err := <-errCh:
-				log.Printf("error while listening for whatsapp messages: %s\n", err.Error())
-				return
-
-			case msgFut := <-queue:
-				msgRes := <-msgFut
-				if msgRes.Err == nil {
-					msgRes.Err = conn.handleWhappMessage(msgRes.Message)
-				}
-
-				if msgRes.Err != nil {
-					log.Printf("error handling new whapp message: %s\n", msgRes.Err)
-					continue
-				}
-			}
-		}
-	}()
+	// setup the bridge, and set it up again every time the user reconnects.
+	// when the session stops by itself the connection ends.
+	if err := conn.runSessions(ctx); err != nil && err != errSessionEnded {
+		return err
+	}
 
-	// now just wait until we have to shutdown.
-	<-ctx.Done()
-	log.Printf("connection ended: %s\n", ctx.Err())
+	cancel()
+	conn.log().Infof("connection ended: %s", ctx.Err())
 	return nil
 }
 
@@ -374,8 +335,7 @@ func (conn *Connection) convertChat(chat whapp.Chat) (*Chat, error) {
 		IsGroupChat:  chat.IsGroupChat,
 		Participants: converted,
 
-		Joined:     false,
-		MessageIDs: make([]string, 0),
+		Joined: false,
 
 		rawChat: chat,
 	}, nil
@@ -390,20 +350,19 @@ func (conn *Connection) addChat(chat *Chat) (res ChatListItem) {
 	defer conn.m.Unlock()
 
 	defer func() {
+		log := conn.log().With("chat", res.Identifier)
 		if chat.IsGroupChat {
-			log.Printf(
-				"%-30s %3d participants\n",
-				res.Identifier,
-				len(res.chat.Participants),
-			)
-		} else {
-			log.Println(res.Identifier)
+			log = log.With("participants", len(res.chat.Participants))
 		}
+		log.Debugf("added chat")
 	}()
 
 	for i, item := range conn.chats {
 		// same chat as we already have, overwrite
 		if item.ID == chat.ID {
+			if item.chat != nil {
+				chat.Joined = item.chat.Joined
+			}
 			item.chat = chat
 			conn.chats[i] = item
 			return item
@@ -429,7 +388,7 @@ func (conn *Connection) addChat(chat *Chat) (res ChatListItem) {
 		chat: chat,
 	}
 	conn.chats = append(conn.chats, item)
-	go conn.saveDatabaseEntry()
+	conn.persister.MarkDirty()
 
 	return item
 }
@@ -438,13 +397,37 @@ func (conn *Connection) saveDatabaseEntry() error {
 	conn.m.RLock()
 	defer conn.m.RUnlock()
 
-	err := userDb.SaveItem(conn.irc.Nick(), User{
+	// there's nothing to save before the user has logged in, this also makes
+	// sure a removed user stays removed.
+	if conn.localStorage == nil && !conn.stateLoaded {
+		return nil
+	}
+
+	user := User{
 		LocalStorage:         conn.localStorage,
 		LastReceivedReceipts: conn.timestampMap.GetCopy(),
 		Chats:                conn.chats,
-	})
+		MessageIDs:           conn.messageIDs.GetCopy(),
+	}
+
+	err := conn.db.SaveItem(conn.irc.Nick(), user)
 	if err != nil {
-		log.Printf("error while updating user entry: %s\n", err)
+		conn.log().Errorf("error while updating user entry: %s", err)
 	}
 	return err
 }
+
+// sendMOTD sends the current message of the day to the user.
+func (conn *Connection) sendMOTD() error {
+	nick := conn.irc.Nick()
+
+	lines := []string{
+		fmt.Sprintf(":whapp-irc 375 %s :The server is running on commit %s", nick, commit),
+	}
+	for _, line := range strings.Split(getConfig().IRCMOTD, "\n") {
+		lines = append(lines, fmt.Sprintf(":whapp-irc 372 %s :%s", nick, line))
+	}
+	lines = append(lines, fmt.Sprintf(":whapp-irc 376 %s :End of /MOTD command.", nick))
+
+	return conn.irc.WriteListNow(lines)
+}
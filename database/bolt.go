@@ -0,0 +1,88 @@
+package database
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStorage is a Storage which stores items in a bucket of an embedded
+// transactional bolt database.
+type BoltStorage struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+// MakeBoltStorage opens the bolt database at the given path, creating it if
+// necessary, and returns a BoltStorage using the given bucket in it.
+func MakeBoltStorage(path, bucket string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{
+		Timeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStorage{
+		db:     db,
+		bucket: []byte(bucket),
+	}, nil
+}
+
+// Get implements Storage.
+func (s *BoltStorage) Get(id string) (bytes []byte, found bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(s.bucket).Get([]byte(id))
+		if val == nil {
+			return nil
+		}
+
+		// val is only valid during the transaction.
+		bytes = make([]byte, len(val))
+		copy(bytes, val)
+		found = true
+		return nil
+	})
+	return bytes, found, err
+}
+
+// Put implements Storage.
+func (s *BoltStorage) Put(id string, bytes []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Put([]byte(id), bytes)
+	})
+}
+
+// Delete implements Storage.
+func (s *BoltStorage) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Delete([]byte(id))
+	})
+}
+
+// List implements Storage.
+func (s *BoltStorage) List() ([]string, error) {
+	var res []string
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).ForEach(func(k, v []byte) error {
+			res = append(res, string(k))
+			return nil
+		})
+	})
+
+	return res, err
+}
+
+// Close implements Storage.
+func (s *BoltStorage) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt parameters used to derive keys.
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+// Sealed contains encrypted and authenticated data.
+type Sealed struct {
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// A Cipher encrypts and decrypts the items stored by an EncryptedStorage.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// MakeCipher derives a key from the given secret, which can be a server
+// secret or a user's password, and the given salt. The salt should be unique
+// per user.
+// Deriving the key is deliberately slow, so the returned Cipher should be
+// reused.
+func MakeCipher(secret, salt string) (*Cipher, error) {
+	key, err := scrypt.Key(
+		[]byte(secret),
+		[]byte("whapp-irc:"+salt),
+		scryptN,
+		scryptR,
+		scryptP,
+		scryptKeyLen,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cipher{aead}, nil
+}
+
+// Seal encrypts the given plaintext.
+func (c *Cipher) Seal(plaintext []byte) (*Sealed, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return &Sealed{
+		Nonce:      nonce,
+		Ciphertext: c.aead.Seal(nil, nonce, plaintext, nil),
+	}, nil
+}
+
+// Open decrypts the given sealed data, it returns ErrWrongKey if the data
+// can't be decrypted using the key of the current Cipher.
+func (c *Cipher) Open(sealed *Sealed) ([]byte, error) {
+	if len(sealed.Nonce) != c.aead.NonceSize() {
+		return nil, ErrWrongKey
+	}
+
+	plaintext, err := c.aead.Open(nil, sealed.Nonce, sealed.Ciphertext, nil)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	return plaintext, nil
+}
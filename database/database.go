@@ -2,32 +2,40 @@ package database
 
 import (
 	"encoding/json"
-	"io/ioutil"
-	"os"
-	"path/filepath"
-	"whapp-irc/database/lockmap"
+	"fmt"
+	"time"
+	"whapp-irc/logger"
 )
 
+// A Database stores JSON encoded items in a Storage, together with the version
+// of their layout.
 type Database struct {
-	Folder  string
-	lockMap *lockmap.LockMap
+	storage    Storage
+	migrations []Migration
 }
 
-// MakeDatabase returns a new Database using the given folder on disk.
-func MakeDatabase(folder string) (*Database, error) {
-	if err := os.MkdirAll(folder, 0700); err != nil {
-		return nil, err
-	}
-
+// MakeDatabase returns a new Database using the given storage.
+// migrations[i] migrates items from version i to version i+1, and is run when
+// loading items stored with an older version.
+func MakeDatabase(storage Storage, migrations ...Migration) *Database {
 	return &Database{
-		Folder:  folder,
-		lockMap: lockmap.New(),
-	}, nil
+		storage:    storage,
+		migrations: migrations,
+	}
 }
 
-func (db *Database) getPath(id string) string {
-	dir, file := filepath.Split(id)
-	return filepath.Join(db.Folder, dir, file+".json")
+// OpenStorage opens the storage with the given backend, which is either "json"
+// for a folder containing a JSON file per item, or "bolt" for a bolt database.
+func OpenStorage(backend, path, bucket string) (Storage, error) {
+	switch backend {
+	case "json":
+		return MakeFileStorage(path)
+	case "bolt":
+		return MakeBoltStorage(path, bucket)
+
+	default:
+		return nil, fmt.Errorf("unknown storage backend %s", backend)
+	}
 }
 
 // GetItem retrieves the item with the given id and, if found, stores the result
@@ -37,23 +45,34 @@ func (db *Database) GetItem(id string, output interface{}) (found bool, err erro
 		return false, ErrIDEmpty
 	}
 
-	readFile := func(id string) ([]byte, error) {
-		unlock := db.lockMap.RLock(id)
-		defer unlock()
-
-		return ioutil.ReadFile(db.getPath(id))
+	bytes, found, err := db.storage.Get(id)
+	if err != nil || !found {
+		return found, err
 	}
 
-	bytes, err := readFile(id)
+	version, data, err := unwrapRecord(bytes)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return false, nil
+		return true, err
+	}
+
+	if version != db.Version() {
+		data, err = db.migrate(version, data)
+		if err != nil {
+			return true, err
 		}
 
-		return true, err
+		// store the migrated item, so we only have to migrate it once.
+		bytes, err := wrapRecord(db.Version(), data)
+		if err != nil {
+			return true, err
+		}
+		if err := db.storage.Put(id, bytes); err != nil {
+			return true, err
+		}
+		logger.Default().Infof("migrated item %s from version %d to %d", id, version, db.Version())
 	}
 
-	return true, json.Unmarshal(bytes, output)
+	return true, json.Unmarshal(data, output)
 }
 
 // SaveItem stores the given item with the given id in the database.
@@ -62,13 +81,32 @@ func (db *Database) SaveItem(id string, item interface{}) error {
 		return ErrIDEmpty
 	}
 
-	bytes, err := json.Marshal(item)
+	data, err := json.Marshal(item)
 	if err != nil {
 		return err
 	}
 
-	unlock := db.lockMap.Lock(id)
-	defer unlock()
+	bytes, err := wrapRecord(db.Version(), data)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	err = db.storage.Put(id, bytes)
+	writeDuration.ObserveSince(start)
+	return err
+}
+
+// DeleteItem removes the item with the given id from the database.
+func (db *Database) DeleteItem(id string) error {
+	if id == "" {
+		return ErrIDEmpty
+	}
+
+	return db.storage.Delete(id)
+}
 
-	return ioutil.WriteFile(db.getPath(id), bytes, 0777)
+// Close closes the storage of the database.
+func (db *Database) Close() error {
+	return db.storage.Close()
 }
@@ -0,0 +1,85 @@
+package database
+
+import "encoding/json"
+
+// sealedItem is the layout in which an EncryptedStorage stores its items.
+type sealedItem struct {
+	Encrypted *Sealed `json:"encrypted"`
+}
+
+// EncryptedStorage is a Storage which encrypts its items before storing them in
+// another Storage.
+// Items stored before encryption was used are returned as is, they're
+// encrypted the next time they're stored.
+type EncryptedStorage struct {
+	storage Storage
+	cipher  *Cipher
+}
+
+// MakeEncryptedStorage returns a new EncryptedStorage storing its items in the
+// given storage, encrypted using the given cipher.
+// When cipher is nil items are stored unencrypted, and encrypted items can't
+// be read.
+func MakeEncryptedStorage(storage Storage, cipher *Cipher) *EncryptedStorage {
+	return &EncryptedStorage{
+		storage: storage,
+		cipher:  cipher,
+	}
+}
+
+// Get implements Storage.
+// It returns ErrNoKey or ErrWrongKey when the item is encrypted and can't be
+// decrypted.
+func (s *EncryptedStorage) Get(id string) (bytes []byte, found bool, err error) {
+	bytes, found, err = s.storage.Get(id)
+	if err != nil || !found {
+		return bytes, found, err
+	}
+
+	var item sealedItem
+	if err := json.Unmarshal(bytes, &item); err != nil || item.Encrypted == nil {
+		// stored before encryption was used.
+		return bytes, true, nil
+	} else if s.cipher == nil {
+		return nil, true, ErrNoKey
+	}
+
+	bytes, err = s.cipher.Open(item.Encrypted)
+	if err != nil {
+		return nil, true, err
+	}
+	return bytes, true, nil
+}
+
+// Put implements Storage.
+func (s *EncryptedStorage) Put(id string, bytes []byte) error {
+	if s.cipher == nil {
+		return s.storage.Put(id, bytes)
+	}
+
+	sealed, err := s.cipher.Seal(bytes)
+	if err != nil {
+		return err
+	}
+
+	bytes, err = json.Marshal(sealedItem{sealed})
+	if err != nil {
+		return err
+	}
+	return s.storage.Put(id, bytes)
+}
+
+// Delete implements Storage.
+func (s *EncryptedStorage) Delete(id string) error {
+	return s.storage.Delete(id)
+}
+
+// List implements Storage.
+func (s *EncryptedStorage) List() ([]string, error) {
+	return s.storage.List()
+}
+
+// Close implements Storage, it closes the underlying storage.
+func (s *EncryptedStorage) Close() error {
+	return s.storage.Close()
+}
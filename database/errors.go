@@ -4,3 +4,15 @@ import "errors"
 
 // ErrIDEmpty will be returned as an error when an empty ID has been given.
 var ErrIDEmpty = errors.New("ID can't be empty")
+
+// ErrWrongKey will be returned as an error when encrypted data can't be
+// decrypted using the given key, or has been tampered with.
+var ErrWrongKey = errors.New("wrong key, or data has been tampered with")
+
+// ErrNoKey will be returned as an error when an item is encrypted, but no key
+// has been given to decrypt it.
+var ErrNoKey = errors.New("item is encrypted, but no key is available")
+
+// ErrVersionTooNew will be returned as an error when an item has been stored
+// by a newer version of whapp-irc, and thus can't be read.
+var ErrVersionTooNew = errors.New("item has been stored by a newer version")
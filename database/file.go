@@ -0,0 +1,140 @@
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"whapp-irc/database/lockmap"
+)
+
+const fileExtension = ".json"
+
+// FileStorage is a Storage which stores every item as a file in a folder.
+type FileStorage struct {
+	Folder  string
+	lockMap *lockmap.LockMap
+}
+
+// MakeFileStorage returns a new FileStorage using the given folder on disk.
+func MakeFileStorage(folder string) (*FileStorage, error) {
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return nil, err
+	}
+
+	return &FileStorage{
+		Folder:  folder,
+		lockMap: lockmap.New(),
+	}, nil
+}
+
+func (s *FileStorage) getPath(id string) string {
+	dir, file := filepath.Split(id)
+	return filepath.Join(s.Folder, dir, file+fileExtension)
+}
+
+// Get implements Storage.
+func (s *FileStorage) Get(id string) (bytes []byte, found bool, err error) {
+	unlock := s.lockMap.RLock(id)
+	defer unlock()
+
+	bytes, err = ioutil.ReadFile(s.getPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+
+		return nil, true, err
+	}
+
+	return bytes, true, nil
+}
+
+// Put implements Storage.
+func (s *FileStorage) Put(id string, bytes []byte) error {
+	unlock := s.lockMap.Lock(id)
+	defer unlock()
+
+	return writeFileAtomic(s.getPath(id), bytes, 0600)
+}
+
+// writeFileAtomic writes the given bytes to a temporary file, syncs it to disk
+// and then renames it to path. This way path contains either the old or the
+// new contents, even when we crash halfway.
+func writeFileAtomic(path string, bytes []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+
+	err = func() error {
+		defer f.Close()
+
+		if _, err := f.Write(bytes); err != nil {
+			return err
+		}
+		if err := f.Chmod(perm); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		return f.Close()
+	}()
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// sync the directory, so that the rename is persisted as well.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// Delete implements Storage.
+func (s *FileStorage) Delete(id string) error {
+	unlock := s.lockMap.Lock(id)
+	defer unlock()
+
+	err := os.Remove(s.getPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List implements Storage.
+func (s *FileStorage) List() ([]string, error) {
+	var res []string
+
+	err := filepath.Walk(s.Folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() || !strings.HasSuffix(path, fileExtension) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.Folder, path)
+		if err != nil {
+			return err
+		}
+		res = append(res, filepath.ToSlash(strings.TrimSuffix(rel, fileExtension)))
+		return nil
+	})
+
+	return res, err
+}
+
+// Close implements Storage.
+func (s *FileStorage) Close() error {
+	return nil
+}
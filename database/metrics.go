@@ -0,0 +1,9 @@
+package database
+
+import "whapp-irc/metrics"
+
+var writeDuration = metrics.NewHistogram(
+	"whapp_irc_database_write_duration_seconds",
+	"The duration of storing an item in the database.",
+	metrics.DefaultBuckets,
+)
@@ -0,0 +1,41 @@
+package database
+
+// A Storage is a backend in which a Database stores its items.
+type Storage interface {
+	// Get returns the bytes stored with the given id, if any.
+	Get(id string) (bytes []byte, found bool, err error)
+	// Put stores the given bytes with the given id, overwriting any previous
+	// value.
+	Put(id string, bytes []byte) error
+	// Delete removes the item with the given id, if any.
+	Delete(id string) error
+	// List returns the ids of all stored items.
+	List() ([]string, error)
+	// Close closes the storage, it can't be used afterwards.
+	Close() error
+}
+
+// Migrate copies all items from src to dst, and returns the amount of items
+// copied.
+func Migrate(dst, src Storage) (n int, err error) {
+	ids, err := src.List()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		bytes, found, err := src.Get(id)
+		if err != nil {
+			return n, err
+		} else if !found {
+			continue
+		}
+
+		if err := dst.Put(id, bytes); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
@@ -0,0 +1,62 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// A Migration converts the JSON encoded data of an item stored with the
+// layout of one version to the layout of the next version.
+type Migration func(data json.RawMessage) (json.RawMessage, error)
+
+// record is the envelope items are stored in, containing the version of the
+// layout of the data.
+type record struct {
+	Version *int            `json:"version"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// unwrapRecord returns the version and data of the given stored item.
+// Items stored before the envelope was introduced are returned as version 0.
+func unwrapRecord(bytes []byte) (version int, data json.RawMessage, err error) {
+	var r record
+	if err := json.Unmarshal(bytes, &r); err != nil {
+		return 0, nil, err
+	}
+
+	if r.Version == nil || r.Data == nil {
+		return 0, bytes, nil
+	}
+	return *r.Version, r.Data, nil
+}
+
+// wrapRecord returns the given data in an envelope with the given version.
+func wrapRecord(version int, data json.RawMessage) ([]byte, error) {
+	return json.Marshal(record{
+		Version: &version,
+		Data:    data,
+	})
+}
+
+// migrate runs the migrations needed to bring the given data, stored with the
+// given version, to the current version.
+func (db *Database) migrate(version int, data json.RawMessage) (json.RawMessage, error) {
+	if version > db.Version() {
+		return nil, ErrVersionTooNew
+	}
+
+	for v := version; v < db.Version(); v++ {
+		var err error
+		data, err = db.migrations[v](data)
+		if err != nil {
+			return nil, fmt.Errorf("error while migrating from version %d to %d: %s", v, v+1, err)
+		}
+	}
+	return data, nil
+}
+
+// Version returns the current version of the layout of items in the database,
+// which is the amount of migrations registered.
+func (db *Database) Version() int {
+	return len(db.migrations)
+}
@@ -0,0 +1,176 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// memoryStorage is a Storage keeping its items in memory.
+type memoryStorage map[string][]byte
+
+func (s memoryStorage) Get(id string) ([]byte, bool, error) {
+	bytes, found := s[id]
+	return bytes, found, nil
+}
+
+func (s memoryStorage) Put(id string, bytes []byte) error {
+	s[id] = bytes
+	return nil
+}
+
+func (s memoryStorage) Delete(id string) error {
+	delete(s, id)
+	return nil
+}
+
+func (s memoryStorage) List() ([]string, error) {
+	var res []string
+	for id := range s {
+		res = append(res, id)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (s memoryStorage) Close() error {
+	return nil
+}
+
+// renameField returns a migration which renames the given field.
+func renameField(from, to string) Migration {
+	return func(data json.RawMessage) (json.RawMessage, error) {
+		var item map[string]json.RawMessage
+		if err := json.Unmarshal(data, &item); err != nil {
+			return nil, err
+		}
+
+		item[to] = item[from]
+		delete(item, from)
+		return json.Marshal(item)
+	}
+}
+
+// testMigrations migrate items from {"a": x} (version 0) to {"b": x} (version
+// 1) to {"c": x} (version 2).
+var testMigrations = []Migration{
+	renameField("a", "b"),
+	renameField("b", "c"),
+}
+
+type testItem struct {
+	C int `json:"c"`
+}
+
+func TestUnwrapRecord(t *testing.T) {
+	cases := []struct {
+		stored  string
+		version int
+		data    string
+	}{
+		// stored before the envelope was introduced.
+		{`{"a":1}`, 0, `{"a":1}`},
+		{`{"data":{"a":1}}`, 0, `{"data":{"a":1}}`},
+		{`{"version":1}`, 0, `{"version":1}`},
+
+		{`{"version":0,"data":{"a":1}}`, 0, `{"a":1}`},
+		{`{"version":2,"data":{"c":1}}`, 2, `{"c":1}`},
+	}
+
+	for _, c := range cases {
+		version, data, err := unwrapRecord([]byte(c.stored))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.stored, err)
+			continue
+		}
+
+		if version != c.version || string(data) != c.data {
+			t.Errorf("%s: got version %d and data %s, expected version %d and data %s", c.stored, version, data, c.version, c.data)
+		}
+	}
+}
+
+func TestGetItemMigrates(t *testing.T) {
+	cases := []string{
+		`{"a":1}`,
+		`{"version":0,"data":{"a":1}}`,
+		`{"version":1,"data":{"b":1}}`,
+		`{"version":2,"data":{"c":1}}`,
+	}
+
+	for _, stored := range cases {
+		storage := memoryStorage{"item": []byte(stored)}
+		db := MakeDatabase(storage, testMigrations...)
+
+		var item testItem
+		found, err := db.GetItem("item", &item)
+		if err != nil || !found {
+			t.Errorf("%s: got found %t and error %v", stored, found, err)
+			continue
+		} else if item.C != 1 {
+			t.Errorf("%s: got %+v, expected c to be 1", stored, item)
+		}
+
+		// the migrated item should be stored with the current version.
+		version, data, err := unwrapRecord(storage["item"])
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", stored, err)
+		} else if version != 2 || string(data) != `{"c":1}` {
+			t.Errorf("%s: stored version %d and data %s after loading", stored, version, data)
+		}
+	}
+}
+
+func TestGetItemVersionTooNew(t *testing.T) {
+	storage := memoryStorage{"item": []byte(`{"version":3,"data":{"d":1}}`)}
+	db := MakeDatabase(storage, testMigrations...)
+
+	var item testItem
+	if _, err := db.GetItem("item", &item); err != ErrVersionTooNew {
+		t.Errorf("got error %v, expected %v", err, ErrVersionTooNew)
+	}
+	if string(storage["item"]) != `{"version":3,"data":{"d":1}}` {
+		t.Errorf("item has been changed to %s", storage["item"])
+	}
+}
+
+func TestGetItemMigrationError(t *testing.T) {
+	failing := func(data json.RawMessage) (json.RawMessage, error) {
+		return nil, fmt.Errorf("failed")
+	}
+
+	storage := memoryStorage{"item": []byte(`{"a":1}`)}
+	db := MakeDatabase(storage, testMigrations[0], failing)
+
+	var item testItem
+	if _, err := db.GetItem("item", &item); err == nil {
+		t.Errorf("expected an error")
+	}
+	if string(storage["item"]) != `{"a":1}` {
+		t.Errorf("item has been changed to %s", storage["item"])
+	}
+}
+
+func TestSaveItemRoundTrip(t *testing.T) {
+	storage := memoryStorage{}
+	db := MakeDatabase(storage, testMigrations...)
+
+	saved := testItem{C: 42}
+	if err := db.SaveItem("item", saved); err != nil {
+		t.Fatal(err)
+	}
+
+	var loaded testItem
+	found, err := db.GetItem("item", &loaded)
+	if err != nil || !found {
+		t.Fatalf("got found %t and error %v", found, err)
+	} else if !reflect.DeepEqual(saved, loaded) {
+		t.Errorf("got %+v, expected %+v", loaded, saved)
+	}
+
+	if version, _, _ := unwrapRecord(storage["item"]); version != 2 {
+		t.Errorf("item stored with version %d, expected 2", version)
+	}
+}
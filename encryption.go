@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"whapp-irc/database"
+)
+
+// makeUserDb makes the database used to store the given user, which encrypts
+// the user using a key derived from the server secret, or the given password
+// if no server secret is set.
+// If neither is available the user is stored unencrypted, and encrypted is
+// false.
+func makeUserDb(user, password string) (db *database.Database, encrypted bool, err error) {
+	secret := databaseSecret
+	if secret == "" {
+		secret = password
+	}
+
+	var cipher *database.Cipher
+	if secret != "" {
+		cipher, err = database.MakeCipher(secret, user)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	storage := database.MakeEncryptedStorage(userStorage, cipher)
+	return database.MakeDatabase(storage, userMigrations...), cipher != nil, nil
+}
+
+// describeKeyError returns an error describing why the stored user can't be
+// decrypted when err is a key error returned by the database, other errors
+// are returned as is.
+func describeKeyError(err error) error {
+	switch err {
+	case database.ErrNoKey:
+		return fmt.Errorf("stored session is encrypted, but no key is available, log in using your IRC password")
+	case database.ErrWrongKey:
+		return fmt.Errorf("stored session can't be decrypted, wrong IRC password or server secret")
+	}
+	return err
+}
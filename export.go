@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"whapp-irc/archive"
+	"whapp-irc/database"
+	"whapp-irc/files"
+)
+
+// exportArgs are the arguments of the export command.
+const exportArgs = "<chat> <json|text|html> [fetch] [since:YYYY-MM-DD] [until:YYYY-MM-DD]"
+
+func init() {
+	registerStatusCommand(StatusCommand{
+		Name:    "export",
+		Args:    exportArgs,
+		Help:    "exports the archived messages of a chat to the file server",
+		MinArgs: 2,
+		Session: true,
+		Run: func(conn *Connection, args []string) error {
+			return conn.exportChat(args[0], args[1], args[2:])
+		},
+	})
+}
+
+// isExportFormat returns whether or not the given format is a valid export
+// format.
+func isExportFormat(format string) bool {
+	for _, f := range archive.Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchMessages returns the messages in the chat of the given item which are
+// still available in WhatsApp Web and match the given query.
+func (conn *Connection) fetchMessages(item ChatListItem, query archive.Query) ([]archive.Message, error) {
+	var since int64
+	if !query.Since.IsZero() {
+		since = query.Since.Unix()
+	}
+
+	messages, err := item.chat.rawChat.GetMessagesFromChatTillDate(
+		conn.bridge.ctx,
+		conn.bridge.WI,
+		since,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []archive.Message
+	for _, msg := range messages {
+		if msg.IsNotification {
+			continue
+		}
+
+		archived := conn.makeArchiveMessage(item.chat, msg)
+		if query.Matches(archived) {
+			res = append(res, archived)
+		}
+	}
+	return res, nil
+}
+
+// exportChat exports the chat with the given identifier in the given format to
+// the file server, and sends the URL to the user. words are the remaining
+// arguments: "fetch" to export the messages from WhatsApp Web instead of the
+// archive, and a query.
+func (conn *Connection) exportChat(identifier, format string, words []string) error {
+	status := conn.irc.Status
+
+	if !isExportFormat(format) {
+		return status("usage: export " + exportArgs)
+	}
+
+	item, has := conn.GetChatByIdentifier(identifier)
+	if !has || item.chat == nil {
+		return status("unknown chat " + identifier)
+	}
+
+	fetch := len(words) > 0 && words[0] == "fetch"
+	if fetch {
+		words = words[1:]
+	}
+
+	query, err := archive.ParseQuery(words)
+	if err != nil {
+		return status(err.Error())
+	}
+
+	var messages []archive.Message
+	if fetch {
+		messages, err = conn.fetchMessages(item, query)
+	} else if messageArchive == nil {
+		return status("the message archive is disabled, use fetch to export the messages from WhatsApp instead")
+	} else {
+		messages, err = messageArchive.Find(conn.irc.Nick(), item.ID.String(), query)
+	}
+	if err != nil {
+		return status("error while retrieving messages: " + err.Error())
+	} else if len(messages) == 0 {
+		return status("no messages found")
+	}
+
+	var buf bytes.Buffer
+	if err := archive.Export(
+		&buf,
+		format,
+		item.chat.Name,
+		messages,
+		mediaURLs(conn.irc.Nick()),
+	); err != nil {
+		return status("error while exporting: " + err.Error())
+	}
+
+	// only the last export of every chat is kept, so that exporting over and
+	// over again doesn't fill up the disk.
+	prefix := exportHashPrefix(item.ID.String())
+	for _, f := range fs.FilesWithPrefix(conn.irc.Nick(), prefix) {
+		if err := fs.RemoveFile(f); err != nil {
+			conn.log().Warningf("error while removing previous export: %s", err)
+		}
+	}
+
+	ext := archive.FormatExtension(format)
+	hash := prefix + strconv.FormatInt(time.Now().UnixNano(), 10)
+	f, err := fs.AddBlob(conn.irc.Nick(), hash, ext, buf.Bytes(), files.Info{
+		Filename:  item.chat.SafeName() + "." + ext,
+		MimeType:  archive.FormatMimeType(format),
+		Chat:      item.chat.Name,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		return status("error while storing export: " + err.Error())
+	}
+
+	return status(fmt.Sprintf("exported %d %s: %s", len(messages), plural(len(messages), "message", "messages"), f.URL))
+}
+
+// exportHashPrefix returns the prefix of the hashes of the exports of the chat
+// with the given ID on the file server.
+func exportHashPrefix(chatID string) string {
+	h := sha1.Sum([]byte(chatID))
+	return "export-" + hex.EncodeToString(h[:8]) + "-"
+}
+
+// getStoredChat returns the stored user with the given name, and the ID and
+// name of its chat with the given identifier or ID.
+// Only the server secret is known here, so users stored encrypted using their
+// IRC password can't be read.
+func getStoredChat(user, chat string) (stored User, chatID, chatName string, err error) {
+	db, _, err := makeUserDb(user, "")
+	if err != nil {
+		return User{}, "", "", err
+	}
+
+	found, err := db.GetItem(user, &stored)
+	if err == database.ErrNoKey {
+		return User{}, "", "", fmt.Errorf("user %s is stored encrypted using their IRC password", user)
+	} else if err != nil {
+		return User{}, "", "", describeKeyError(err)
+	} else if !found {
+		return User{}, "", "", fmt.Errorf("user %s not found", user)
+	}
+
+	for _, item := range stored.Chats {
+		if item.Identifier == chat || item.ID.String() == chat {
+			return stored, item.ID.String(), item.Identifier, nil
+		}
+	}
+
+	if strings.Contains(chat, "@") {
+		// not in the chat list (anymore), but it's an ID.
+		return stored, chat, chat, nil
+	}
+	return User{}, "", "", fmt.Errorf("chat %s not found", chat)
+}
+
+// exportArchive writes the archived messages of the given user in the chat
+// with the given identifier or ID matching the given query to w.
+func exportArchive(w io.Writer, user, chat, format string, query archive.Query) error {
+	if !isExportFormat(format) {
+		return fmt.Errorf("unknown export format %s", format)
+	} else if messageArchive == nil {
+		return fmt.Errorf("the message archive is disabled")
+	}
+
+	_, chatID, chatName, err := getStoredChat(user, chat)
+	if err != nil {
+		return err
+	}
+
+	messages, err := messageArchive.Find(user, chatID, query)
+	if err != nil {
+		return err
+	} else if len(messages) == 0 {
+		return fmt.Errorf("no messages found in %s", chat)
+	}
+
+	return archive.Export(w, format, chatName, messages, mediaURLs(user))
+}
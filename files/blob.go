@@ -0,0 +1,143 @@
+package files
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const metadataExtension = ".json"
+
+// Info contains information about a file as it has been received by an user.
+type Info struct {
+	Filename  string `json:"filename,omitempty"`
+	MimeType  string `json:"mimeType,omitempty"`
+	Sender    string `json:"sender,omitempty"`
+	Chat      string `json:"chat,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+
+	Caption string `json:"caption,omitempty"`
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+	Preview string `json:"preview,omitempty"` // base64 encoded JPEG
+
+	Duration int `json:"duration,omitempty"` // in seconds
+}
+
+// Ownership contains the information a single user has about a blob.
+type Ownership struct {
+	Info
+	AddedAt int64 `json:"addedAt"`
+}
+
+// blob is a file stored once on disk, which can be owned by multiple users.
+// Its metadata is persisted next to the file itself.
+type blob struct {
+	Hash   string                `json:"hash"`
+	Ext    string                `json:"ext"`
+	Size   int64                 `json:"size"`
+	Owners map[string]*Ownership `json:"owners"`
+
+	// Variants contains the extensions of alternative versions of this blob,
+	// for example a transcoded version, which are stored next to it.
+	Variants []string `json:"variants,omitempty"`
+
+	// legacy is true for blobs that were stored before files were namespaced
+	// per user, these don't have metadata on disk and are served without
+	// access control.
+	legacy bool
+}
+
+func (b *blob) fileName() string {
+	urlHash, err := b64tob64url(b.Hash)
+	if err != nil {
+		urlHash = b.Hash
+	}
+
+	if b.Ext == "" {
+		return urlHash
+	}
+	return urlHash + "." + b.Ext
+}
+
+func (b *blob) hasVariant(ext string) bool {
+	for _, v := range b.Variants {
+		if v == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *blob) hasOwner(user string) bool {
+	_, has := b.Owners[user]
+	return has
+}
+
+// isMetadataFile returns whether the file with the given name is the metadata
+// of a blob, names contains the names of all files next to it.
+// Blobs can have the same extension as metadata, for example received JSON
+// documents, so only files next to the blob they describe are metadata.
+func isMetadataFile(fname string, names map[string]bool) bool {
+	return strings.HasSuffix(fname, metadataExtension) &&
+		names[strings.TrimSuffix(fname, metadataExtension)]
+}
+
+func metadataPath(blobPath string) string {
+	return blobPath + metadataExtension
+}
+
+func variantPath(blobPath, ext string) string {
+	return blobPath + "." + ext
+}
+
+// readBlob reads the metadata of the blob stored at the given path.
+func readBlob(blobPath string) (*blob, error) {
+	bytes, err := ioutil.ReadFile(metadataPath(blobPath))
+	if err != nil {
+		return nil, err
+	}
+
+	var b blob
+	if err := json.Unmarshal(bytes, &b); err != nil {
+		return nil, err
+	}
+	if b.Owners == nil {
+		b.Owners = make(map[string]*Ownership)
+	}
+	return &b, nil
+}
+
+// writeMetadata writes the metadata of the given blob next to it in dir.
+func writeMetadata(dir string, b *blob) error {
+	bytes, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	path := metadataPath(filepath.Join(dir, b.fileName()))
+	return ioutil.WriteFile(path, bytes, 0600)
+}
+
+// removeBlob removes the given blob, its metadata, thumbnail and variants from
+// dir.
+func removeBlob(dir string, b *blob) error {
+	path := filepath.Join(dir, b.fileName())
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	paths := []string{metadataPath(path), thumbnailPath(path)}
+	for _, ext := range b.Variants {
+		paths = append(paths, variantPath(path, ext))
+	}
+
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,18 +3,41 @@ package files
 import (
 	"fmt"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"sync"
+	"time"
+	"whapp-irc/database/lockmap"
+	"whapp-irc/logger"
 )
 
+// tempFilePrefix is the prefix of the names of temporary files in the directory
+// of the file server.
+const tempFilePrefix = ".tmp-"
+
+// A File is a blob on the file server as seen by one of its owners.
 type File struct {
 	Hash string
+	User string
 	Path string
 	URL  string
 }
 
+// PreviewURL returns the URL to the HTML preview page of the current file.
+func (f *File) PreviewURL() string {
+	return f.URL + "/preview"
+}
+
+// VariantURL returns the URL to the variant of the current file with the
+// given extension.
+func (f *File) VariantURL(ext string) string {
+	return f.URL + "/" + ext
+}
+
 type FileServer struct {
 	Host      string
 	Port      string
@@ -22,19 +45,28 @@ type FileServer struct {
 	Directory string
 
 	httpServer *http.Server
+	log        *logger.Logger
+	thumbnails *lockmap.LockMap
 
 	mutex      sync.RWMutex
-	hashToPath map[string]*File
+	hashToBlob map[string]*blob
+	nameToBlob map[string]*blob
 }
 
-func MakeFileServer(host, port, dir string, useHTTPS bool) (*FileServer, error) {
+// MakeFileServer makes a new FileServer serving the files stored in dir, which
+// logs to log.
+func MakeFileServer(host, port, dir string, useHTTPS bool, log *logger.Logger) (*FileServer, error) {
 	fs := &FileServer{
 		Host:      host,
 		Port:      port,
 		UseHTTPS:  useHTTPS,
 		Directory: dir,
 
-		hashToPath: make(map[string]*File),
+		log:        log,
+		thumbnails: lockmap.New(),
+
+		hashToBlob: make(map[string]*blob),
+		nameToBlob: make(map[string]*blob),
 	}
 
 	err := os.Mkdir("./"+dir, 0700)
@@ -48,14 +80,31 @@ func MakeFileServer(host, port, dir string, useHTTPS bool) (*FileServer, error)
 			return nil, err
 		}
 
+		names := make(map[string]bool, len(files))
+		for _, f := range files {
+			names[f.Name()] = true
+		}
+
 		for _, f := range files {
 			fname := f.Name()
 			dotIndex := strings.LastIndexByte(fname, '.')
 
-			if f.IsDir() || fname[0] == '.' {
+			if f.IsDir() || fname[0] == '.' || isMetadataFile(fname, names) || isThumbnailFile(fname) {
 				continue
 			}
 
+			b, err := readBlob(fs.path(fname))
+			if err == nil {
+				fs.addBlob(b)
+				continue
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+
+			// no metadata found, this is a file stored before files were
+			// stored per user.
+			// variants and thumbnails of blobs also end up here, but their
+			// names aren't valid base64 so they're skipped below.
 			var b64url string
 			var ext string
 			if dotIndex == -1 { // no extension
@@ -71,20 +120,39 @@ func MakeFileServer(host, port, dir string, useHTTPS bool) (*FileServer, error)
 				continue
 			}
 
-			fs.hashToPath[hash] = fs.makeFile(hash, ext)
+			fs.addBlob(&blob{
+				Hash:   hash,
+				Ext:    ext,
+				Size:   f.Size(),
+				Owners: make(map[string]*Ownership),
+
+				legacy: true,
+			})
 		}
 	}
 
 	return fs, nil
 }
 
+// Start starts listening on the port of the current file server, and serves
+// the files in the background once it's listening.
 func (fs *FileServer) Start() error {
+	listener, err := net.Listen("tcp", ":"+fs.Port)
+	if err != nil {
+		return err
+	}
+
 	fs.httpServer = &http.Server{
-		Addr:    ":" + fs.Port,
-		Handler: noDirListing(http.FileServer(http.Dir(fs.Directory))),
+		Handler:  fs,
+		ErrorLog: fs.log.StdLogger(logger.LevelWarning),
 	}
 
-	return fs.httpServer.ListenAndServe()
+	go func(server *http.Server) {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fs.log.Errorf("error while serving files: %s", err)
+		}
+	}(fs.httpServer)
+	return nil
 }
 
 func (fs *FileServer) Stop() error {
@@ -96,21 +164,125 @@ func (fs *FileServer) Stop() error {
 	return nil
 }
 
-func (fs *FileServer) makeFile(hash, ext string) *File {
-	if hash == "" {
-		return nil
+// ServeHTTP serves the files on the current file server, every file is only
+// accessible under the namespace of its owners: /<user>/<file>.
+// Thumbnails and a preview page are served at /<user>/<file>/thumb and
+// /<user>/<file>/preview respectively.
+func (fs *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	urlHash, err := b64tob64url(hash)
-	if err != nil {
-		urlHash = hash
+	// never let browsers guess the type of files sent by others.
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	var user, fname, action string
+	split := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch len(split) {
+	case 1:
+		fname = split[0]
+	case 2:
+		user, fname = split[0], split[1]
+	case 3:
+		user, fname, action = split[0], split[1], split[2]
+	default:
+		http.NotFound(w, r)
+		return
 	}
 
-	var fname string
-	if ext != "" {
-		fname = urlHash + "." + ext
-	} else {
-		fname = urlHash
+	fs.mutex.RLock()
+	b, has := fs.nameToBlob[fname]
+	allowed := has && fname != "" &&
+		((user == "" && b.legacy) || (user != "" && b.hasOwner(user)))
+	var info Info
+	var variants []string
+	if allowed {
+		if user != "" {
+			info = b.Owners[user].Info
+		}
+		variants = b.Variants
+	}
+	fs.mutex.RUnlock()
+
+	log := fs.log.With("user", user).With("file", fname)
+	if !allowed {
+		log.Debugf("file not found")
+		http.NotFound(w, r)
+		return
+	}
+	log.Debugf("serving file %s", r.URL.Path)
+
+	switch action {
+	case "":
+		break
+
+	case "thumb":
+		bytes, err := fs.getThumbnail(fname, info)
+		if err != nil {
+			log.Warningf("error while getting thumbnail: %s", err)
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		if _, err := w.Write(bytes); err != nil {
+			log.Debugf("error while writing thumbnail: %s", err)
+		}
+		return
+
+	case "preview":
+		bytes, err := renderPreview("/"+url.PathEscape(user)+"/"+fname, info, variants)
+		if err != nil {
+			log.Warningf("error while rendering preview: %s", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if _, err := w.Write(bytes); err != nil {
+			log.Debugf("error while writing preview: %s", err)
+		}
+		return
+
+	default:
+		if !containsString(variants, action) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if info.Filename != "" {
+			info.Filename += "." + action
+		}
+		info.MimeType = mime.TypeByExtension("." + action)
+		fname = variantPath(fname, action)
+	}
+
+	// the type is chosen by the sender, so files can't run scripts even when
+	// a browser shows them.
+	info.MimeType = contentType(fname, info)
+	w.Header().Set("Content-Type", info.MimeType)
+	w.Header().Set("Content-Disposition", contentDisposition(info))
+	w.Header().Set("Content-Security-Policy", "sandbox")
+
+	http.ServeFile(w, r, fs.path(fname))
+}
+
+func (fs *FileServer) path(fname string) string {
+	return fmt.Sprintf("./%s/%s", fs.Directory, fname)
+}
+
+func (fs *FileServer) addBlob(b *blob) {
+	fs.hashToBlob[b.Hash] = b
+	fs.nameToBlob[b.fileName()] = b
+}
+
+func (fs *FileServer) makeFile(user string, b *blob) *File {
+	if b == nil || b.Hash == "" {
+		return nil
+	}
+
+	fname := b.fileName()
+	if user != "" {
+		fname = url.PathEscape(user) + "/" + fname
 	}
 
 	protocol := "http"
@@ -124,53 +296,286 @@ func (fs *FileServer) makeFile(hash, ext string) *File {
 		url = fmt.Sprintf("%s://%s:%s/%s", protocol, fs.Host, fs.Port, fname)
 	}
 
-	path := fmt.Sprintf("./%s/%s", fs.Directory, fname)
-
 	return &File{
-		Hash: hash,
+		Hash: b.Hash,
+		User: user,
 		URL:  url,
-		Path: path,
+		Path: fs.path(b.fileName()),
+	}
+}
+
+// claim adds the given user as owner of the given blob with the given info and
+// persists this.
+// The caller must hold the write lock.
+func (fs *FileServer) claim(user string, b *blob, info Info) error {
+	if b.hasOwner(user) {
+		return nil
+	}
+
+	b.Owners[user] = &Ownership{
+		Info:    info,
+		AddedAt: time.Now().Unix(),
+	}
+	b.legacy = false
+
+	if err := writeMetadata(fs.Directory, b); err != nil {
+		delete(b.Owners, user)
+		return err
 	}
+	return nil
 }
 
-func (fs *FileServer) AddBlob(hash, ext string, bytes []byte) (*File, error) {
+// AddBlob stores the given bytes with the given hash and info for the given
+// user.
+// When a blob with the same hash is already on disk, it isn't written again,
+// instead the user is added as an owner of the existing blob.
+func (fs *FileServer) AddBlob(user, hash, ext string, bytes []byte, info Info) (*File, error) {
 	fs.mutex.Lock()
 	defer fs.mutex.Unlock()
 
-	if hash == "" || len(bytes) == 0 {
-		return nil, fmt.Errorf("hash or bytes can't be empty")
+	if user == "" || hash == "" || len(bytes) == 0 {
+		return nil, fmt.Errorf("user, hash or bytes can't be empty")
+	}
+
+	b, has := fs.hashToBlob[hash]
+	if !has {
+		b = &blob{
+			Hash:   hash,
+			Ext:    ext,
+			Size:   int64(len(bytes)),
+			Owners: make(map[string]*Ownership),
+		}
+
+		if err := ioutil.WriteFile(fs.path(b.fileName()), bytes, 0644); err != nil {
+			return nil, err
+		}
+		fs.addBlob(b)
 	}
 
-	f := fs.makeFile(hash, ext)
-	if f == nil {
-		return nil, fmt.Errorf("error while creating file object")
+	if err := fs.claim(user, b, info); err != nil {
+		return nil, err
 	}
 
-	err := ioutil.WriteFile(f.Path, bytes, 0644)
+	return fs.makeFile(user, b), nil
+}
+
+// RemoveTempFiles removes the temporary files left behind by downloads that
+// were interrupted by a crash. It must only be called when no other process
+// uses the directory of the file server.
+func (fs *FileServer) RemoveTempFiles() error {
+	files, err := ioutil.ReadDir("./" + fs.Directory)
 	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), tempFilePrefix) {
+			continue
+		}
+
+		if err := os.Remove(fs.path(f.Name())); err != nil {
+			fs.log.Warningf("error while removing temporary file %s: %s", f.Name(), err)
+		}
+	}
+	return nil
+}
+
+// TempFile creates a new temporary file in the directory of the file server,
+// which can later be added using AddFile.
+// The caller is responsible for removing the file when it isn't added.
+func (fs *FileServer) TempFile() (*os.File, error) {
+	return ioutil.TempFile("./"+fs.Directory, tempFilePrefix)
+}
+
+// AddFile moves the file at the given path, which should be on the same file
+// system as the file server directory (see TempFile), into the file server
+// using the given hash and info for the given user.
+// When a blob with the same hash is already on disk, the file at path is
+// removed and the user is added as an owner of the existing blob.
+func (fs *FileServer) AddFile(user, hash, ext, path string, info Info) (*File, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if user == "" || hash == "" {
+		return nil, fmt.Errorf("user or hash can't be empty")
+	}
+
+	b, has := fs.hashToBlob[hash]
+	if has {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		} else if stat.Size() == 0 {
+			return nil, fmt.Errorf("file can't be empty")
+		}
+
+		b = &blob{
+			Hash:   hash,
+			Ext:    ext,
+			Size:   stat.Size(),
+			Owners: make(map[string]*Ownership),
+		}
+
+		if err := os.Chmod(path, 0644); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(path, fs.path(b.fileName())); err != nil {
+			return nil, err
+		}
+		fs.addBlob(b)
+	}
+
+	if err := fs.claim(user, b, info); err != nil {
 		return nil, err
 	}
 
-	fs.hashToPath[hash] = f
-	return f, nil
+	return fs.makeFile(user, b), nil
+}
+
+// Claim adds the given user as an owner of the already stored blob with the
+// given hash and the given info, without having to store it again.
+func (fs *FileServer) Claim(user, hash string, info Info) (file *File, has bool, err error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	b, has := fs.hashToBlob[hash]
+	if !has {
+		return nil, false, nil
+	}
+
+	if err := fs.claim(user, b, info); err != nil {
+		return nil, true, err
+	}
+	return fs.makeFile(user, b), true, nil
 }
 
+// RemoveFile removes the ownership of the given file's user, the blob on disk
+// is removed when it has no owners left.
 func (fs *FileServer) RemoveFile(file *File) error {
 	fs.mutex.Lock()
 	defer fs.mutex.Unlock()
 
-	if err := os.Remove(file.Path); err != nil {
+	b, has := fs.hashToBlob[file.Hash]
+	if !has {
+		return nil
+	}
+
+	delete(b.Owners, file.User)
+	if len(b.Owners) > 0 {
+		return writeMetadata(fs.Directory, b)
+	}
+
+	if err := removeBlob(fs.Directory, b); err != nil {
 		return err
 	}
 
-	delete(fs.hashToPath, file.Hash)
+	delete(fs.hashToBlob, b.Hash)
+	delete(fs.nameToBlob, b.fileName())
 	return nil
 }
 
-func (fs *FileServer) GetFileByHash(hash string) (file *File, has bool) {
+// GetFileByHash returns the file with the given hash owned by the given user,
+// if any.
+func (fs *FileServer) GetFileByHash(user, hash string) (file *File, has bool) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	b, has := fs.hashToBlob[hash]
+	if !has || !b.hasOwner(user) {
+		return nil, false
+	}
+	return fs.makeFile(user, b), true
+}
+
+// GetInfo returns the info the given user has about the given file.
+func (fs *FileServer) GetInfo(file *File) (info Info, size int64, has bool) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	b, has := fs.hashToBlob[file.Hash]
+	if !has || !b.hasOwner(file.User) {
+		return Info{}, 0, false
+	}
+	return b.Owners[file.User].Info, b.Size, true
+}
+
+// AddVariant stores the given bytes as the variant with the given extension of
+// the given file.
+func (fs *FileServer) AddVariant(file *File, ext string, bytes []byte) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	b, has := fs.hashToBlob[file.Hash]
+	if !has {
+		return fmt.Errorf("file not found")
+	} else if b.hasVariant(ext) {
+		return nil
+	}
+
+	path := variantPath(fs.path(b.fileName()), ext)
+	if err := ioutil.WriteFile(path, bytes, 0644); err != nil {
+		return err
+	}
+
+	b.Variants = append(b.Variants, ext)
+	return writeMetadata(fs.Directory, b)
+}
+
+// HasVariant returns whether or not the given file has a variant with the
+// given extension.
+func (fs *FileServer) HasVariant(file *File, ext string) bool {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	b, has := fs.hashToBlob[file.Hash]
+	return has && b.hasVariant(ext)
+}
+
+// UpdateInfo calls fn with the info the user of the given file has about it,
+// and persists the changes made by fn.
+func (fs *FileServer) UpdateInfo(file *File, fn func(info *Info)) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	b, has := fs.hashToBlob[file.Hash]
+	if !has || !b.hasOwner(file.User) {
+		return fmt.Errorf("file not found")
+	}
+
+	fn(&b.Owners[file.User].Info)
+	return writeMetadata(fs.Directory, b)
+}
+
+// FilesWithPrefix returns the files owned by the given user whose hash starts
+// with the given prefix.
+func (fs *FileServer) FilesWithPrefix(user, prefix string) []*File {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	var res []*File
+	for hash, b := range fs.hashToBlob {
+		if strings.HasPrefix(hash, prefix) && b.hasOwner(user) {
+			res = append(res, fs.makeFile(user, b))
+		}
+	}
+	return res
+}
+
+// Usage returns the amount of files owned by the given user, and their total
+// size in bytes.
+func (fs *FileServer) Usage(user string) (count int, size int64) {
 	fs.mutex.RLock()
 	defer fs.mutex.RUnlock()
 
-	file, has = fs.hashToPath[hash]
-	return file, has
+	for _, b := range fs.hashToBlob {
+		if b.hasOwner(user) {
+			count++
+			size += b.Size
+		}
+	}
+	return count, size
 }
@@ -0,0 +1,65 @@
+package files
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"whapp-irc/logger"
+)
+
+// TestReopenJSONBlob checks that received JSON documents, which are stored
+// with the same extension as metadata, are still found after restarting.
+func TestReopenJSONBlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whapp-irc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the file server is stored relative to the working directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	log := logger.New(ioutil.Discard, logger.LevelError, logger.FormatText)
+	blobs := []struct {
+		hash string
+		ext  string
+		info Info
+	}{
+		{"anNvbi1kb2N1bWVudA==", "json", Info{Filename: "data.json", MimeType: "application/json"}},
+		{"cG5nLWltYWdl", "png", Info{MimeType: "image/png"}},
+	}
+
+	fs, err := MakeFileServer("localhost", "3000", "files", false, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range blobs {
+		if _, err := fs.AddBlob("alice", b.hash, b.ext, []byte("{}"), b.info); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs, err = MakeFileServer("localhost", "3000", "files", false, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range blobs {
+		file, has := fs.GetFileByHash("alice", b.hash)
+		if !has {
+			t.Errorf("blob %s.%s not found after reopening", b.hash, b.ext)
+			continue
+		}
+
+		info, _, has := fs.GetInfo(file)
+		if !has || info != b.info {
+			t.Errorf("got info %+v for blob %s.%s, expected %+v", info, b.hash, b.ext, b.info)
+		}
+	}
+}
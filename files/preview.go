@@ -0,0 +1,104 @@
+package files
+
+import (
+	"bytes"
+	"html/template"
+	"mime"
+	"strings"
+	"time"
+)
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>{{.Title}}</title>
+	<style>
+		body { font-family: sans-serif; max-width: 50em; margin: 1em auto; padding: 0 1em; }
+		img, video { max-width: 100%; height: auto; }
+		.meta { color: #666; }
+	</style>
+</head>
+<body>
+	{{if eq .Kind "image"}}
+	<a href="{{.URL}}"><img src="{{.URL}}" alt="{{.Title}}"{{if .Width}} width="{{.Width}}" height="{{.Height}}"{{end}}></a>
+	{{else if eq .Kind "video"}}
+	<video src="{{.URL}}" controls{{if .ThumbnailURL}} poster="{{.ThumbnailURL}}"{{end}}{{if .Width}} width="{{.Width}}" height="{{.Height}}"{{end}}></video>
+	{{else if eq .Kind "audio"}}
+	<audio controls>
+		{{range .Variants}}<source src="{{.URL}}"{{if .MimeType}} type="{{.MimeType}}"{{end}}>
+		{{end}}<source src="{{.URL}}"{{if .MimeType}} type="{{.MimeType}}"{{end}}>
+	</audio>
+	{{else}}
+	<a href="{{.URL}}">{{.Title}}</a>
+	{{end}}
+	{{if .Caption}}<p>{{.Caption}}</p>{{end}}
+	<p class="meta">
+		{{if .Sender}}{{.Sender}}{{end}}{{if .Chat}} in {{.Chat}}{{end}}
+		{{if not .Time.IsZero}}&mdash; {{.Time.Format "2006-01-02 15:04:05"}}{{end}}
+		{{if .Duration}}({{.Duration}}s){{end}}
+	</p>
+</body>
+</html>
+`))
+
+type previewSource struct {
+	URL      string
+	MimeType string
+}
+
+type previewData struct {
+	Info
+
+	Kind         string
+	Title        string
+	URL          string
+	ThumbnailURL string
+	Time         time.Time
+	Variants     []previewSource
+}
+
+// previewKind returns the kind of preview to show for the given mime type.
+func previewKind(mimeType string) string {
+	for _, kind := range []string{"image", "video", "audio"} {
+		if strings.HasPrefix(mimeType, kind+"/") {
+			return kind
+		}
+	}
+	return "file"
+}
+
+// renderPreview renders a HTML page previewing the file at the given URL, and
+// its variants with the given extensions.
+func renderPreview(url string, info Info, variants []string) ([]byte, error) {
+	data := previewData{
+		Info: info,
+
+		Kind:  previewKind(info.MimeType),
+		Title: info.Filename,
+		URL:   url,
+	}
+
+	if data.Title == "" {
+		data.Title = "whapp-irc media"
+	}
+	if info.Preview != "" {
+		data.ThumbnailURL = url + "/thumb"
+	}
+	if info.Timestamp != 0 {
+		data.Time = time.Unix(info.Timestamp, 0)
+	}
+	for _, ext := range variants {
+		data.Variants = append(data.Variants, previewSource{
+			URL:      url + "/" + ext,
+			MimeType: mime.TypeByExtension("." + ext),
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := previewTemplate.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
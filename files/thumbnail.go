@@ -0,0 +1,184 @@
+package files
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	// register decoders for the image formats we can make thumbnails of.
+	_ "image/gif"
+	_ "image/png"
+)
+
+const (
+	thumbnailExtension = ".thumb.jpg"
+	thumbnailSize      = 320
+	thumbnailQuality   = 80
+
+	// maxThumbnailPixels is the maximum amount of pixels of an image we make a
+	// thumbnail of, decoding an image takes a few bytes of memory per pixel.
+	maxThumbnailPixels = 32 * 1000 * 1000
+)
+
+// errImageTooLarge is returned by makeThumbnail when the image has more than
+// maxThumbnailPixels pixels.
+var errImageTooLarge = errors.New("image too large")
+
+func isThumbnailFile(fname string) bool {
+	return strings.HasSuffix(fname, thumbnailExtension)
+}
+
+func thumbnailPath(blobPath string) string {
+	return blobPath + thumbnailExtension
+}
+
+// scaleImage scales the given image so that it fits in a square of size by
+// size pixels, keeping the aspect ratio. Every pixel in the result is the
+// average of the pixels it covers in the source image.
+func scaleImage(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+
+	dw, dh := size, size
+	if w > h {
+		dh = h * size / w
+	} else {
+		dw = w * size / h
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0 := bounds.Min.Y + y*h/dh
+		y1 := bounds.Min.Y + (y+1)*h/dh
+
+		for x := 0; x < dw; x++ {
+			x0 := bounds.Min.X + x*w/dw
+			x1 := bounds.Min.X + (x+1)*w/dw
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					b += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(b / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+
+	return dst
+}
+
+// makeThumbnail makes a JPEG thumbnail of the image stored at the given path.
+func makeThumbnail(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// the size is chosen by the sender, so check it before decoding.
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, err
+	} else if int64(config.Width)*int64(config.Height) > maxThumbnailPixels {
+		return nil, errImageTooLarge
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleImage(img, thumbnailSize), &jpeg.Options{
+		Quality: thumbnailQuality,
+	}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// getThumbnail returns a thumbnail for the blob with the given file name.
+// Thumbnails of images are generated once and cached next to the blob, for
+// other media the preview sent by WhatsApp is used, if any.
+func (fs *FileServer) getThumbnail(fname string, info Info) ([]byte, error) {
+	if strings.HasPrefix(info.MimeType, "image/") {
+		unlock := fs.thumbnails.Lock(fname)
+		defer unlock()
+
+		path := fs.path(fname)
+		bytes, err := ioutil.ReadFile(thumbnailPath(path))
+		if err == nil {
+			return bytes, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		bytes, err = makeThumbnail(path)
+		if err == nil {
+			if err := fs.writeThumbnail(thumbnailPath(path), bytes); err != nil {
+				return nil, err
+			}
+			return bytes, nil
+		}
+		// we can't decode this image, try the WhatsApp preview.
+	}
+
+	if info.Preview == "" {
+		return nil, fmt.Errorf("no thumbnail available")
+	}
+	return base64.StdEncoding.DecodeString(info.Preview)
+}
+
+// writeThumbnail writes the given thumbnail to a temporary file and then
+// renames it to path, so that path never contains a partial thumbnail.
+func (fs *FileServer) writeThumbnail(path string, bytes []byte) error {
+	f, err := fs.TempFile()
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(bytes)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -2,8 +2,8 @@ package files
 
 import (
 	"encoding/base64"
-	"net/http"
-	"path"
+	"mime"
+	"path/filepath"
 )
 
 func b64tob64url(str string) (string, error) {
@@ -22,13 +22,65 @@ func b64urltob64(str string) (string, error) {
 	return base64.StdEncoding.EncodeToString(bytes), nil
 }
 
-func noDirListing(handler http.Handler) http.HandlerFunc {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if path.Clean(r.URL.Path) == "/" {
-			http.NotFound(w, r)
-			return
-		}
+// inlineTypes are the types of media shown inline by the file server, every
+// other type is offered as a download, since types like image/svg+xml can
+// contain scripts which would run on the origin of the file server.
+var inlineTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp", "image/bmp",
+	"video/mp4", "video/3gpp", "video/webm", "video/quicktime",
+	"audio/ogg", "audio/mpeg", "audio/mp4", "audio/aac", "audio/amr",
+	"audio/wav", "audio/webm",
+}
+
+// contentType returns the value of the Content-Type header for the file with
+// the given name and info, falling back to a type based on the extension of
+// fname and then to application/octet-stream.
+func contentType(fname string, info Info) string {
+	typ := info.MimeType
+	if typ == "" {
+		typ = mime.TypeByExtension(filepath.Ext(fname))
+	}
+
+	if _, _, err := mime.ParseMediaType(typ); err != nil {
+		return "application/octet-stream"
+	}
+	return typ
+}
+
+// isInlineType returns whether or not media with the given type can safely be
+// shown inline.
+func isInlineType(typ string) bool {
+	mediaType, _, err := mime.ParseMediaType(typ)
+	return err == nil && containsString(inlineTypes, mediaType)
+}
 
-		handler.ServeHTTP(w, r)
+// contentDisposition returns the value of the Content-Disposition header for a
+// file with the given info, safe media is shown inline and the rest is offered
+// as a download, both using the original filename.
+func contentDisposition(info Info) string {
+	typ := "attachment"
+	if isInlineType(info.MimeType) {
+		typ = "inline"
+	}
+
+	if info.Filename == "" {
+		return typ
+	}
+	res := mime.FormatMediaType(typ, map[string]string{
+		"filename": info.Filename,
 	})
+	if res == "" {
+		// filename contains characters that can't be formatted.
+		return typ
+	}
+	return res
+}
+
+func containsString(slice []string, str string) bool {
+	for _, x := range slice {
+		if x == str {
+			return true
+		}
+	}
+	return false
 }
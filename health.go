@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+	"whapp-irc/whapp"
+)
+
+const (
+	// readyPollTimeout is the maximum duration since the last successful poll
+	// for new messages for a session to be ready.
+	readyPollTimeout = 30 * time.Second
+
+	// phoneActiveInterval is the interval with which we check whether the
+	// phone of a user is connected.
+	phoneActiveInterval = 10 * time.Second
+)
+
+// SessionHealth keeps track of the health of the WhatsApp session of a
+// connection.
+type SessionHealth struct {
+	m sync.RWMutex
+
+	wi               *whapp.Instance
+	phoneActive      bool
+	phoneActiveKnown bool
+	lastMessage      time.Time
+}
+
+// MakeSessionHealth makes a new SessionHealth of a session which isn't logged
+// in yet.
+func MakeSessionHealth() *SessionHealth {
+	return &SessionHealth{}
+}
+
+// LoggedIn marks the session as logged in using the given instance.
+func (h *SessionHealth) LoggedIn(wi *whapp.Instance) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.wi = wi
+}
+
+// IsLoggedIn returns whether the session is logged in.
+func (h *SessionHealth) IsLoggedIn() bool {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	return h.wi != nil
+}
+
+// LoggedOut marks the session as logged out.
+func (h *SessionHealth) LoggedOut() {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.wi = nil
+	h.phoneActiveKnown = false
+}
+
+// SetPhoneActive sets whether or not the phone of the user is connected.
+func (h *SessionHealth) SetPhoneActive(active bool) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.phoneActive = active
+	h.phoneActiveKnown = true
+}
+
+// MessageReceived marks that a message has been received just now.
+func (h *SessionHealth) MessageReceived() {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.lastMessage = time.Now()
+}
+
+// SessionStatus is the status of the WhatsApp session of a user, as shown on
+// the admin server.
+type SessionStatus struct {
+	User        string     `json:"user"`
+	LoginState  string     `json:"loginState"`
+	PhoneActive *bool      `json:"phoneActive"`
+	LastPoll    *time.Time `json:"lastPoll"`
+	LastMessage *time.Time `json:"lastMessage"`
+	Ready       bool       `json:"ready"`
+}
+
+// Status returns the status of the session of the given user.
+// The session is ready when it's logged in and has successfully polled for
+// new messages recently.
+func (h *SessionHealth) Status(user string) SessionStatus {
+	h.m.RLock()
+	defer h.m.RUnlock()
+
+	optionalTime := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+
+	res := SessionStatus{
+		User:        user,
+		LoginState:  whapp.Loggedout.String(),
+		LastMessage: optionalTime(h.lastMessage),
+	}
+	if h.phoneActiveKnown {
+		active := h.phoneActive
+		res.PhoneActive = &active
+	}
+
+	if h.wi != nil {
+		lastPoll := h.wi.LastPoll()
+
+		res.LoginState = whapp.Loggedin.String()
+		res.LastPoll = optionalTime(lastPoll)
+		res.Ready = !lastPoll.IsZero() && time.Since(lastPoll) < readyPollTimeout
+	}
+
+	return res
+}
+
+// SessionStatuses returns the status of the sessions of all connections whose
+// user is known, sorted by user.
+func (r *ConnectionRegistry) SessionStatuses() []SessionStatus {
+	r.m.Lock()
+	var conns []*Connection
+	for conn := range r.conns {
+		conns = append(conns, conn)
+	}
+	r.m.Unlock()
+
+	res := make([]SessionStatus, 0)
+	for _, conn := range conns {
+		if user := conn.irc.Nick(); user != "" {
+			res = append(res, conn.health.Status(user))
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].User < res[j].User
+	})
+	return res
+}
@@ -1,17 +1,88 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"io"
 	"strings"
 	"time"
-	"whapp-irc/ircConnection"
 
 	"gopkg.in/sorcix/irc.v2"
 	"gopkg.in/sorcix/irc.v2/ctcp"
 )
 
-func (conn *Connection) handleIRCCommand(msg *irc.Message) error {
+// handleIRCMessages handles the messages received on ch using handle, until
+// ctx is done or the IRC connection is closed.
+func (conn *Connection) handleIRCMessages(
+	ctx context.Context,
+	cancel context.CancelFunc,
+	ch <-chan *irc.Message,
+	handle func(msg *irc.Message) error,
+) {
+	defer cancel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+
+			if err := handle(msg); err != nil {
+				conn.log().Errorf("error handling new irc message: %s", err)
+
+				if err == io.ErrClosedPipe {
+					return
+				}
+				continue
+			}
+		}
+	}
+}
+
+// handleIRCCommand handles the given message sent by the IRC client, messages
+// which need WhatsApp are sent on queue to be handled when a session is set
+// up.
+func (conn *Connection) handleIRCCommand(
+	ctx context.Context,
+	msg *irc.Message,
+	queue chan<- *irc.Message,
+) error {
+	switch {
+	case msg.Command == "MOTD":
+		return conn.sendMOTD()
+
+	case msg.Command == "PRIVMSG" && len(msg.Params) > 1 && msg.Params[0] == "status":
+		body := msg.Params[1]
+		conn.logMessage(time.Now(), conn.irc.Nick(), "status", body)
+		return conn.handleStatusCommand(body)
+	}
+
+	if conn.sessionReady() {
+		select {
+		case <-ctx.Done():
+			return nil
+		case queue <- msg:
+			return nil
+		}
+	}
+
+	// don't block while there's no session, so that PINGs are still answered
+	// while WhatsApp Web is starting.
+	select {
+	case queue <- msg:
+		return nil
+	default:
+		return conn.irc.Status("not connected to whatsapp yet, try again later")
+	}
+}
+
+// handleSessionCommand handles the given message sent by the IRC client, which
+// needs WhatsApp.
+func (conn *Connection) handleSessionCommand(msg *irc.Message) error {
 	write := conn.irc.WriteNow
 	status := conn.irc.Status
 
@@ -24,11 +95,7 @@ func (conn *Connection) handleIRCCommand(msg *irc.Message) error {
 			body = fmt.Sprintf("_%s_", text)
 		}
 
-		ircConnection.LogMessage(time.Now(), conn.irc.Nick(), to, body)
-
-		if to == "status" {
-			return nil
-		}
+		conn.logMessage(time.Now(), conn.irc.Nick(), to, body)
 
 		item, has := conn.GetChatByIdentifier(to)
 		if !has {
@@ -41,9 +108,10 @@ func (conn *Connection) handleIRCCommand(msg *irc.Message) error {
 			body,
 		); err != nil {
 			str := fmt.Sprintf("err while sending: %s", err.Error())
-			log.Println(str)
+			conn.log().With("chat", to).Errorf("%s", str)
 			return status(str)
 		}
+		messagesBridged.Inc(directionToWhatsApp, "chat")
 
 	case "JOIN":
 		idents := strings.Split(msg.Params[0], ",")
@@ -107,7 +175,7 @@ func (conn *Connection) handleIRCCommand(msg *irc.Message) error {
 				op,
 			); err != nil {
 				str := fmt.Sprintf("error while opping %s: %s", nick, err.Error())
-				log.Println(str)
+				conn.log().With("chat", ident).Errorf("%s", str)
 				return status(str)
 			}
 
@@ -241,7 +309,7 @@ func (conn *Connection) handleIRCCommand(msg *irc.Message) error {
 				p.ID,
 			); err != nil {
 				str := fmt.Sprintf("error while kicking %s: %s", nick, err.Error())
-				log.Println(str)
+				conn.log().With("chat", chatIdentifier).Errorf("%s", str)
 				return status(str)
 			}
 
@@ -277,7 +345,7 @@ func (conn *Connection) handleIRCCommand(msg *irc.Message) error {
 			personChatInfo.chat.ID,
 		); err != nil {
 			str := fmt.Sprintf("error while adding %s: %s", nick, err.Error())
-			log.Println(str)
+			conn.log().With("chat", chatIdentifier).Errorf("%s", str)
 			return status(str)
 		}
 	}
@@ -5,11 +5,12 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 	"whapp-irc/capabilities"
+	"whapp-irc/logger"
 
 	"github.com/olebedev/emitter"
 	irc "gopkg.in/sorcix/irc.v2"
@@ -27,21 +28,27 @@ type IRCConnection struct {
 	tomb    *tomb.Tomb
 	emitter *emitter.Emitter
 
-	nick string
+	nick     string
+	password string
+
+	// log contains the *logger.Logger of the current connection.
+	log atomic.Value
 
 	// TODO: remove this
 	socket *net.TCPConn
 }
 
-func sendMessage(socket *net.TCPConn, msg string) error {
+func (conn *IRCConnection) sendMessage(msg string) error {
+	conn.Log().Tracef(logger.IRCTraffic, "-> %s", msg)
+
 	bytes := []byte(msg + "\n")
 
-	n, err := socket.Write(bytes)
+	n, err := conn.socket.Write(bytes)
 	if err == nil && n != len(bytes) {
 		err = fmt.Errorf("bytes length mismatch")
 	}
 	if err != nil {
-		log.Printf("error sending irc message: %s", err)
+		conn.Log().Warningf("error sending irc message: %s", err)
 	}
 	return err
 }
@@ -49,7 +56,9 @@ func sendMessage(socket *net.TCPConn, msg string) error {
 // HandleConnection wraps around the given socket connection, which you
 // shouldn't use after providing it.  It will then handle all the IRC connection
 // stuff for you.  You should interface with it using it's methods.
-func HandleConnection(ctx context.Context, socket *net.TCPConn) *IRCConnection {
+// Everything is logged to log, with the address of the client and the nick of
+// the user as fields.
+func HandleConnection(ctx context.Context, socket *net.TCPConn, log *logger.Logger) *IRCConnection {
 	tomb, ctx := tomb.WithContext(ctx)
 	conn := &IRCConnection{
 		Caps: capabilities.MakeCapabilitiesMap(),
@@ -62,6 +71,7 @@ func HandleConnection(ctx context.Context, socket *net.TCPConn) *IRCConnection {
 
 		socket: socket,
 	}
+	conn.log.Store(log.With("remote", socket.RemoteAddr().String()))
 
 	// close socket when connection ends
 	go func() {
@@ -83,7 +93,7 @@ func HandleConnection(ctx context.Context, socket *net.TCPConn) *IRCConnection {
 					return fmt.Errorf("send channel closed")
 				}
 
-				if err := sendMessage(socket, msg); err != nil {
+				if err := conn.sendMessage(msg); err != nil {
 					return err
 				}
 			}
@@ -102,25 +112,36 @@ func HandleConnection(ctx context.Context, socket *net.TCPConn) *IRCConnection {
 			msg, err := decoder.Decode()
 			if err != nil {
 				if err != io.EOF {
-					log.Printf("error while listening for IRC messages: %s\n", err)
+					conn.Log().Warningf("error while listening for IRC messages: %s", err)
 				}
 				return err
 			} else if msg == nil {
-				log.Println("got invalid IRC message, ignoring")
+				conn.Log().Warningf("got invalid IRC message, ignoring")
 				continue
 			}
 
+			if msg.Command == "PASS" {
+				conn.Log().Tracef(logger.IRCTraffic, "<- PASS <hidden>")
+			} else {
+				conn.Log().Tracef(logger.IRCTraffic, "<- %s", msg)
+			}
+
 			switch msg.Command {
 			case "PING":
 				str := ":whapp-irc PONG whapp-irc :" + msg.Params[0]
 				if err := conn.WriteNow(str); err != nil {
-					log.Printf("error while sending PONG: %s", err)
+					conn.Log().Warningf("error while sending PONG: %s", err)
 					return err
 				}
 			case "QUIT":
-				log.Printf("received QUIT from %s", conn.nick)
+				conn.Log().Infof("received QUIT")
 				return fmt.Errorf("got QUIT")
 
+			case "PASS":
+				if len(msg.Params) > 0 {
+					conn.password = msg.Params[0]
+				}
+
 			case "NICK":
 				conn.setNick(msg.Params[0])
 
@@ -161,7 +182,7 @@ func (conn *IRCConnection) Write(time time.Time, msg string) error {
 		msg = fmt.Sprintf("@time=%s %s", timeFormat, msg)
 	}
 
-	return sendMessage(conn.socket, msg)
+	return conn.sendMessage(msg)
 	//conn.ch <- msg
 }
 
@@ -181,10 +202,16 @@ func (conn *IRCConnection) WriteListNow(messages []string) error {
 	return nil
 }
 
+// SetWriteDeadline sets the deadline after which writes to the current
+// connection fail instead of blocking, see net.Conn.
+func (conn *IRCConnection) SetWriteDeadline(t time.Time) error {
+	return conn.socket.SetWriteDeadline(t)
+}
+
 // Status writes the given message as if sent by 'status' to the current
 // connection.
 func (conn *IRCConnection) Status(body string) error {
-	LogMessage(time.Now(), "status", conn.nick, body)
+	conn.LogMessage(time.Now(), "status", conn.nick, body)
 	msg := FormatPrivateMessage("status", conn.nick, body)
 	return conn.WriteNow(msg)
 }
@@ -198,6 +225,7 @@ func (conn *IRCConnection) ReceiveChannel() <-chan *irc.Message {
 // notifies any listeners.
 func (conn *IRCConnection) setNick(nick string) {
 	conn.nick = nick
+	conn.log.Store(conn.Log().With("user", nick))
 	<-conn.emitter.Emit("nick", nick)
 }
 
@@ -213,6 +241,18 @@ func (conn *IRCConnection) Nick() string {
 	return conn.nick
 }
 
+// Password returns the password the user at the other end of the current
+// connection sent using PASS, if any.
+func (conn *IRCConnection) Password() string {
+	return conn.password
+}
+
+// Log returns the logger of the current connection, which adds the address of
+// the client and, once it's known, the nick of the user to every line.
+func (conn *IRCConnection) Log() *logger.Logger {
+	return conn.log.Load().(*logger.Logger)
+}
+
 // Close closes the current connection
 func (conn *IRCConnection) Close() {
 	conn.tomb.Killf("IRCConnection.Close() called")
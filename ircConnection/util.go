@@ -2,13 +2,22 @@ package ircConnection
 
 import (
 	"fmt"
-	"log"
 	"time"
+	"whapp-irc/logger"
 )
 
-func LogMessage(time time.Time, from, to, message string) {
-	timeStr := time.Format("2006-01-02 15:04:05")
-	log.Printf("(%s) %s->%s: %s", timeStr, from, to, message)
+// LogMessage writes the given message to the log of the current connection.
+// The contents of the message are only logged when logging of message contents
+// is enabled.
+func (conn *IRCConnection) LogMessage(time time.Time, from, to, message string) {
+	log := conn.Log().
+		With("from", from).
+		With("to", to).
+		With("sent_at", time.Format("2006-01-02 15:04:05"))
+	if log.Enabled(logger.MessageContents) {
+		log = log.With("message", message)
+	}
+	log.Infof("message")
 }
 
 func FormatPrivateMessage(from, to, line string) string {
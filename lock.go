@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// dataLockFile is the file in the working directory, which contains the data
+// of whapp-irc, that is locked while whapp-irc or a command changing its data
+// is running.
+const dataLockFile = "whapp-irc.lock"
+
+// errDataLocked is returned by lockData when the data is already locked.
+var errDataLocked = errors.New("whapp-irc is already running using the data in this directory, stop it first")
+
+// lockData locks the data of whapp-irc in the working directory, so that only
+// one process changes it at a time, and returns a function to unlock it.
+func lockData() (unlock func(), err error) {
+	f, err := os.OpenFile(dataLockFile, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errDataLocked
+		}
+		return nil, err
+	}
+
+	return func() { f.Close() }, nil
+}
@@ -0,0 +1,339 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// Level is the severity of a log line.
+type Level int32
+
+const (
+	// LevelDebug is used for information which is only useful when debugging.
+	LevelDebug Level = iota
+	// LevelInfo is used for normal operation.
+	LevelInfo
+	// LevelWarning is used for problems which whapp-irc can recover from.
+	LevelWarning
+	// LevelError is used for problems which stop something from working.
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarning:
+		return "warning"
+	default:
+		return "error"
+	}
+}
+
+// Format is the format log lines are written in.
+type Format int32
+
+const (
+	// FormatText writes log lines as text, with fields as key=value pairs.
+	FormatText Format = iota
+	// FormatJSON writes every log line as a JSON object.
+	FormatJSON
+)
+
+// Category is a kind of verbose output which can be enabled independently of
+// the level.
+type Category uint32
+
+const (
+	// CDPTraffic is the communication with the chromium instances.
+	CDPTraffic Category = 1 << iota
+	// IRCTraffic is every message sent to and received from IRC clients.
+	IRCTraffic
+	// MessageContents is the contents of bridged messages.
+	MessageContents
+)
+
+func (c Category) String() string {
+	switch c {
+	case CDPTraffic:
+		return "cdp"
+	case IRCTraffic:
+		return "irc"
+	case MessageContents:
+		return "message-contents"
+	default:
+		return "unknown"
+	}
+}
+
+// output is the destination and settings shared by a Logger and the loggers
+// derived from it.
+type output struct {
+	m sync.Mutex
+	w io.Writer
+
+	level      int32
+	format     int32
+	categories uint32
+}
+
+// Field is a key with a value added to every line of a Logger.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// A Logger writes levelled log lines with fields.
+type Logger struct {
+	out    *output
+	fields []Field
+}
+
+var std = New(os.Stderr, LevelInfo, FormatText)
+
+// Default returns the default logger, which writes to stderr.
+func Default() *Logger {
+	return std
+}
+
+// New makes a new Logger writing lines with the given level or higher to w,
+// using the given format.
+func New(w io.Writer, level Level, format Format) *Logger {
+	return &Logger{
+		out: &output{
+			w:      w,
+			level:  int32(level),
+			format: int32(format),
+		},
+	}
+}
+
+// SetLevel sets the minimum level of the lines written by the current logger
+// and the loggers derived from it.
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.out.level, int32(level))
+}
+
+// SetFormat sets the format of the lines written by the current logger and the
+// loggers derived from it.
+func (l *Logger) SetFormat(format Format) {
+	atomic.StoreInt32(&l.out.format, int32(format))
+}
+
+// SetEnabled sets whether or not the given category is logged by the current
+// logger and the loggers derived from it.
+func (l *Logger) SetEnabled(category Category, enabled bool) {
+	for {
+		old := atomic.LoadUint32(&l.out.categories)
+		new := old &^ uint32(category)
+		if enabled {
+			new |= uint32(category)
+		}
+
+		if atomic.CompareAndSwapUint32(&l.out.categories, old, new) {
+			return
+		}
+	}
+}
+
+// Enabled returns whether or not the given category is logged.
+func (l *Logger) Enabled(category Category) bool {
+	return atomic.LoadUint32(&l.out.categories)&uint32(category) != 0
+}
+
+// With returns a logger which adds the given field to every line, in addition
+// to the fields of the current logger.
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]Field, 0, len(l.fields)+1)
+	for _, f := range l.fields {
+		if f.Key != key {
+			fields = append(fields, f)
+		}
+	}
+
+	return &Logger{
+		out:    l.out,
+		fields: append(fields, Field{key, value}),
+	}
+}
+
+// Debugf logs a line with the debug level.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, nil, format, args...)
+}
+
+// Infof logs a line with the info level.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, nil, format, args...)
+}
+
+// Warningf logs a line with the warning level.
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	l.logf(LevelWarning, nil, format, args...)
+}
+
+// Errorf logs a line with the error level.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, nil, format, args...)
+}
+
+// Tracef logs a line of the given category with the debug level, when the
+// category is enabled. The level of the logger is ignored for these lines.
+func (l *Logger) Tracef(category Category, format string, args ...interface{}) {
+	if !l.Enabled(category) {
+		return
+	}
+	l.logf(LevelDebug, &category, format, args...)
+}
+
+// TraceFunc returns a printf-like function which calls Tracef with the given
+// category, for libraries which take a logging function.
+func (l *Logger) TraceFunc(category Category) func(string, ...interface{}) {
+	return func(format string, args ...interface{}) {
+		l.Tracef(category, format, args...)
+	}
+}
+
+// StdLogger returns a log.Logger writing every line to the current logger with
+// the given level, for libraries which take a log.Logger.
+func (l *Logger) StdLogger(level Level) *log.Logger {
+	return log.New(l.Writer(level), "", 0)
+}
+
+// Writer returns an io.Writer writing every line written to it to the current
+// logger with the given level.
+func (l *Logger) Writer(level Level) io.Writer {
+	return writer{l, level}
+}
+
+// writer is an io.Writer writing every line to a Logger.
+type writer struct {
+	l     *Logger
+	level Level
+}
+
+func (w writer) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	w.l.logf(w.level, nil, "%s", msg)
+	return len(p), nil
+}
+
+func (l *Logger) logf(level Level, category *Category, format string, args ...interface{}) {
+	if category == nil && level < Level(atomic.LoadInt32(&l.out.level)) {
+		return
+	}
+
+	t := time.Now()
+	msg := fmt.Sprintf(format, args...)
+
+	fields := l.fields
+	if category != nil {
+		fields = append(fields[:len(fields):len(fields)], Field{"category", category.String()})
+	}
+
+	var buf bytes.Buffer
+	switch Format(atomic.LoadInt32(&l.out.format)) {
+	case FormatJSON:
+		writeJSON(&buf, t, level, msg, fields)
+	default:
+		writeText(&buf, t, level, msg, fields)
+	}
+
+	l.out.m.Lock()
+	defer l.out.m.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
+
+func writeText(buf *bytes.Buffer, t time.Time, level Level, msg string, fields []Field) {
+	fmt.Fprintf(
+		buf,
+		"%s %-7s %s",
+		t.Format("2006/01/02 15:04:05"),
+		strings.ToUpper(level.String()),
+		strings.TrimRight(msg, "\n"),
+	)
+
+	for _, f := range fields {
+		buf.WriteByte(' ')
+		buf.WriteString(f.Key)
+		buf.WriteByte('=')
+		buf.WriteString(formatTextValue(f.Value))
+	}
+	buf.WriteByte('\n')
+}
+
+// formatTextValue formats the given value, quoting it when it's empty or
+// contains spaces, quotes or control characters.
+func formatTextValue(v interface{}) string {
+	str := fmt.Sprint(v)
+	if err, ok := v.(error); ok {
+		str = err.Error()
+	}
+
+	needsQuotes := str == ""
+	for _, r := range str {
+		if r == '"' || r == '=' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			needsQuotes = true
+			break
+		}
+	}
+
+	if needsQuotes {
+		return strconv.Quote(str)
+	}
+	return str
+}
+
+// writeJSON writes the line as a JSON object, starting with the time, level
+// and message, followed by the fields in order.
+func writeJSON(buf *bytes.Buffer, t time.Time, level Level, msg string, fields []Field) {
+	all := append([]Field{
+		{"time", t.Format(time.RFC3339Nano)},
+		{"level", level.String()},
+		{"msg", strings.TrimRight(msg, "\n")},
+	}, fields...)
+
+	buf.WriteByte('{')
+	for i, f := range all {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		value := f.Value
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+
+		writeJSONValue(buf, f.Key)
+		buf.WriteByte(':')
+		if err := writeJSONValue(buf, value); err != nil {
+			writeJSONValue(buf, fmt.Sprint(value))
+		}
+	}
+	buf.WriteString("}\n")
+}
+
+// writeJSONValue writes v as JSON to buf, without escaping HTML characters.
+func writeJSONValue(buf *bytes.Buffer, v interface{}) error {
+	var tmp bytes.Buffer
+	enc := json.NewEncoder(&tmp)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+
+	buf.Write(bytes.TrimRight(tmp.Bytes(), "\n"))
+	return nil
+}
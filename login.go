@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"whapp-irc/files"
+	"whapp-irc/whapp"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// loginCodeTimeout is the maximum duration to wait for WhatsApp Web to show a
+// login code.
+const loginCodeTimeout = 30 * time.Second
+
+// logoutTimeout is the maximum duration to wait for WhatsApp Web to log out.
+const logoutTimeout = 15 * time.Second
+
+// LoginCodes keeps track of the QR codes sent to the user while a WhatsApp Web
+// instance is waiting to be logged in.
+type LoginCodes struct {
+	m sync.Mutex
+
+	ctx   context.Context
+	wi    *whapp.Instance
+	files []*files.File
+}
+
+func init() {
+	registerStatusCommand(StatusCommand{
+		Name: "qr",
+		Help: "sends a new QR code to log in with",
+		Run: func(conn *Connection, args []string) error {
+			return conn.resendLoginCode()
+		},
+	})
+}
+
+// MakeLoginCodes makes a new LoginCodes which isn't waiting for a login.
+func MakeLoginCodes() *LoginCodes {
+	return &LoginCodes{}
+}
+
+// startLogin marks the given instance as waiting to be logged in, and sends
+// a QR code to log in with to the user.
+func (conn *Connection) startLogin(ctx context.Context, wi *whapp.Instance) error {
+	conn.login.m.Lock()
+	conn.login.ctx = ctx
+	conn.login.wi = wi
+	conn.login.m.Unlock()
+
+	return conn.sendLoginCode()
+}
+
+// finishLogin marks the instance as no longer waiting to be logged in, and
+// removes the QR codes sent to the user.
+func (conn *Connection) finishLogin() {
+	conn.login.m.Lock()
+	defer conn.login.m.Unlock()
+
+	for _, f := range conn.login.files {
+		if err := fs.RemoveFile(f); err != nil {
+			conn.log().Warningf("error while removing QR code: %s", err)
+		}
+	}
+
+	conn.login.ctx = nil
+	conn.login.wi = nil
+	conn.login.files = nil
+}
+
+// sendLoginCode retrieves the current login code of the instance waiting to be
+// logged in, and sends it as a QR code to the user.
+func (conn *Connection) sendLoginCode() error {
+	conn.login.m.Lock()
+	ctx, wi := conn.login.ctx, conn.login.wi
+	conn.login.m.Unlock()
+
+	if wi == nil {
+		return whapp.ErrLoggedIn
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, loginCodeTimeout)
+	defer cancel()
+
+	code, err := wi.GetLoginCode(ctx)
+	if err != nil {
+		return fmt.Errorf("Error while retrieving login code: %s", err.Error())
+	}
+
+	bytes, err := qrcode.Encode(code, qrcode.High, 512)
+	if err != nil {
+		return err
+	}
+
+	qrFile, err := fs.AddBlob(
+		conn.irc.Nick(),
+		"qr-"+strTimestamp(),
+		"png",
+		bytes,
+		files.Info{MimeType: "image/png"},
+	)
+	if err != nil {
+		return err
+	}
+
+	conn.login.m.Lock()
+	defer conn.login.m.Unlock()
+
+	if conn.login.wi != wi {
+		// logged in while we were retrieving the code.
+		if err := fs.RemoveFile(qrFile); err != nil {
+			conn.log().Warningf("error while removing QR code: %s", err)
+		}
+		return whapp.ErrLoggedIn
+	}
+	conn.login.files = append(conn.login.files, qrFile)
+
+	return conn.irc.Status("Scan this QR code: " + qrFile.URL)
+}
+
+// resendLoginCode sends a new QR code to the user, if a WhatsApp Web instance
+// is waiting to be logged in.
+func (conn *Connection) resendLoginCode() error {
+	err := conn.sendLoginCode()
+	if err == whapp.ErrLoggedIn {
+		if conn.sessionReady() {
+			return conn.irc.Status("already logged in")
+		}
+		return conn.irc.Status("not waiting for a login, try again later")
+	} else if err != nil {
+		return conn.irc.Status("error while sending QR code: " + err.Error())
+	}
+	return nil
+}
+
+// unlink logs out of WhatsApp Web when it's logged in, which unlinks the
+// bridge from the phone of the user. When the session is still being set up
+// after logging in, it waits for the setup to finish first. It gives up after
+// logoutTimeout, the caller stops the session and removes the stored state
+// either way.
+func (conn *Connection) unlink(ctx context.Context) {
+	unlinked := false
+	logout := func() error {
+		unlinked = true
+
+		ctx, cancel := context.WithTimeout(conn.bridge.ctx, logoutTimeout)
+		defer cancel()
+
+		err := conn.bridge.WI.Logout(ctx)
+		if conn.bridge.ctx.Err() != nil {
+			// the session stopped after WhatsApp Web logged out.
+			return nil
+		}
+		return err
+	}
+
+	ok, err := conn.withSession(logout)
+	if !ok {
+		if !conn.health.IsLoggedIn() {
+			// there's nothing to unlink.
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, logoutTimeout)
+		defer cancel()
+		err = conn.waitSession(ctx, logout)
+		if !unlinked {
+			// the setup failed or didn't finish in time.
+			err = errors.New("the session isn't set up")
+		}
+	}
+	if err != nil {
+		conn.log().Warningf("error while logging out of whatsapp web: %s", err)
+		conn.irc.Status("error while logging out of whatsapp web, your stored session is removed anyway but unlink whapp-irc using your phone: " + err.Error())
+	}
+}
+
+// removeCredentials removes the stored WhatsApp session, so the next session
+// logs in using a new QR code.
+func (conn *Connection) removeCredentials() error {
+	conn.m.Lock()
+	conn.localStorage = nil
+	conn.m.Unlock()
+
+	return conn.persister.Flush()
+}
+
+// removeUserState removes the stored WhatsApp session and chat state of the
+// user, so the next session starts as if the user connected for the first
+// time.
+func (conn *Connection) removeUserState() error {
+	conn.m.Lock()
+	conn.localStorage = nil
+	conn.me = whapp.Me{}
+	conn.chats = nil
+	conn.stateLoaded = false
+	conn.timestampMap.Swap(make(map[string]int64))
+	conn.messageIDs.Swap(make(map[string][]string))
+	conn.m.Unlock()
+
+	// nothing is saved until the user logs in again, so the user stays removed.
+	return conn.db.DeleteItem(conn.irc.Nick())
+}
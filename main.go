@@ -1,50 +1,111 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"os"
 	"time"
+	"whapp-irc/archive"
+	"whapp-irc/chatLog"
 	"whapp-irc/config"
 	"whapp-irc/database"
 	"whapp-irc/files"
-	"whapp-irc/maps"
-	"whapp-irc/whapp"
+	"whapp-irc/logger"
 
 	"github.com/chromedp/chromedp"
 )
 
 var (
-	fs     *files.FileServer
-	userDb *database.Database
-	pool   *chromedp.Pool
+	fs             *files.FileServer
+	userStorage    database.Storage
+	messageArchive *archive.Archive
+	chatLogger     *chatLog.Logger
+	pool           *chromedp.Pool
+	connections    = MakeConnectionRegistry()
 
-	loggingLevel      whapp.LoggingLevel
-	mapProvider       maps.Provider
-	alternativeReplay bool
+	browserHeadless bool
+
+	databaseSecret string
 
 	startTime = time.Now()
 	commit    string
 )
 
-func makePool(loggingLevel whapp.LoggingLevel) (*chromedp.Pool, error) {
-	switch loggingLevel {
-	case whapp.LogLevelVerbose:
-		return chromedp.NewPool(chromedp.PoolLog(log.Printf, log.Printf, log.Printf))
-	default:
-		return chromedp.NewPool()
-	}
+// makePool makes the pool of chromium instances, its communication with them
+// is logged when logger.CDPTraffic is enabled.
+func makePool() (*chromedp.Pool, error) {
+	trace := logger.Default().TraceFunc(logger.CDPTraffic)
+	return chromedp.NewPool(chromedp.PoolLog(trace, trace, trace))
 }
 
 func main() {
-	config, err := config.ReadEnvVars()
+	config, args, err := config.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if config.CheckOnly {
+		if config.File == "" {
+			fmt.Println("configuration is valid (no config file used)")
+		} else {
+			fmt.Printf("configuration is valid (using %s)\n", config.File)
+		}
+		return
+	}
+
+	// libraries logging using the log package end up in our log too.
+	log.SetFlags(0)
+	log.SetOutput(logger.Default().Writer(logger.LevelInfo))
+
+	browserHeadless = config.BrowserHeadless
+	databaseSecret = config.DatabaseSecret
+	applyConfig(config)
+
+	if ran, err := runCommand(args, config); ran {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	unlock, err := lockData()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer unlock()
+
+	userStorage, err = database.OpenStorage(
+		config.DatabaseBackend,
+		config.DatabasePath,
+		userBucket,
+	)
 	if err != nil {
 		panic(err)
 	}
-	loggingLevel = config.LoggingLevel
-	mapProvider = config.MapProvider
-	alternativeReplay = config.AlternativeReplay
+	defer userStorage.Close()
+
+	if config.ArchiveMessages {
+		messageArchive, err = archive.MakeArchive(config.ArchivePath)
+		if err != nil {
+			panic(err)
+		}
+	}
 
-	userDb, err = database.MakeDatabase("db/users")
+	// users enable chat logs in their settings, which can change while
+	// running.
+	chatLogger, err = chatLog.MakeLogger(
+		config.ChatLogPath,
+		config.ChatLogMaxSize,
+		config.ChatLogKeep,
+	)
 	if err != nil {
 		panic(err)
 	}
@@ -54,18 +115,30 @@ func main() {
 		config.FileServerPort,
 		"files",
 		config.FileServerHTTPS,
+		logger.Default().With("component", "fileserver"),
 	)
 	if err != nil {
 		panic(err)
 	}
-	go func() {
-		if err := fs.Start(); err != nil {
-			log.Printf("error while starting fileserver: %s", err)
-		}
-	}()
+	if err := fs.RemoveTempFiles(); err != nil {
+		logger.Default().Warningf("error while removing temporary files: %s", err)
+	}
+	if err := fs.Start(); err != nil {
+		panic(err)
+	}
 	defer fs.Stop()
 
-	pool, err = makePool(loggingLevel)
+	if config.AdminPort != "" {
+		admin := makeAdminServer(config.AdminHost, config.AdminPort)
+		go func() {
+			if err := admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Default().Errorf("error while starting admin server: %s", err)
+			}
+		}()
+		defer admin.Close()
+	}
+
+	pool, err = makePool()
 	if err != nil {
 		panic(err)
 	}
@@ -80,17 +153,39 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	setListening()
+
+	go watchReloadSignal(os.Args[1:])
+
+	stopping := make(chan struct{})
+	go func() {
+		sig := waitForShutdownSignal()
+		logger.Default().Infof("received %s, shutting down", sig)
+
+		close(stopping)
+		listener.Close()
+	}()
 
 	for {
 		socket, err := listener.AcceptTCP()
 		if err != nil {
-			log.Printf("error accepting TCP connection: %s", err)
+			select {
+			case <-stopping:
+				logger.Default().Infof("stopping %d connection(s)", connections.Len())
+				if !connections.Shutdown(shutdownTimeout) {
+					logger.Default().Warningf("not every connection stopped within %s", shutdownTimeout)
+				}
+				return
+			default:
+			}
+
+			logger.Default().Errorf("error accepting TCP connection: %s", err)
 			continue
 		}
 
 		go func() {
 			if err := BindSocket(socket); err != nil {
-				log.Println(err)
+				logger.Default().Errorf("%s", err)
 			}
 		}()
 	}
@@ -9,6 +9,15 @@ const (
 	OpenStreetMap
 )
 
+func (p Provider) String() string {
+	switch p {
+	case OpenStreetMap:
+		return "openstreetmap"
+	default:
+		return "googlemaps"
+	}
+}
+
 // googleMaps returns a URL to the given latitude and longitude on Google Maps.
 func googleMaps(latitude, longitude float64) string {
 	return fmt.Sprintf(
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+	"whapp-irc/files"
+	"whapp-irc/logger"
+	"whapp-irc/whapp"
+)
+
+// mediaDownloadTries is the amount of times we try to download media which
+// turns out to be corrupt before giving up.
+const mediaDownloadTries = 3
+
+// hasPreviewPage returns whether or not we link to the preview page instead of
+// the file itself for messages with the given type.
+func hasPreviewPage(typ string) bool {
+	switch typ {
+	case "image", "video", "audio", "ptt":
+		return true
+	}
+	return false
+}
+
+func getMediaInfo(msg whapp.Message) files.Info {
+	var sender string
+	if msg.Sender != nil {
+		sender = msg.Sender.GetName()
+	}
+
+	info := files.Info{
+		Filename:  msg.MediaFilename,
+		MimeType:  msg.MimeType,
+		Sender:    sender,
+		Chat:      msg.Chat.Title(),
+		Timestamp: msg.Timestamp,
+
+		Caption: msg.Caption,
+		Width:   msg.MediaData.FullWidth,
+		Height:  msg.MediaData.FullHeight,
+		Preview: msg.MediaData.Preview.Base64,
+	}
+
+	if duration, known := msg.MediaDuration(); known {
+		info.Duration = int(duration / time.Second)
+	}
+	return info
+}
+
+// downloadMediaOnce downloads and decrypts the media of the given message into
+// a temporary file on the file server and returns its path.
+func downloadMediaOnce(ctx context.Context, log *logger.Logger, msg whapp.Message) (path string, err error) {
+	encrypted, err := fs.TempFile()
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(encrypted.Name())
+	defer encrypted.Close()
+
+	decrypted, err := fs.TempFile()
+	if err != nil {
+		return "", err
+	}
+
+	w := bufio.NewWriter(decrypted)
+	err = msg.DownloadMedia(ctx, log, w, encrypted, getConfig().MediaDownloadOptions)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := decrypted.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(decrypted.Name())
+		return "", err
+	}
+	return decrypted.Name(), nil
+}
+
+// downloadMedia downloads the media of the given message into a temporary file
+// on the file server, retrying when the downloaded media is corrupt.
+// Downloads that fail for another reason than being cancelled or the media
+// being too large are counted in mediaDownloadFailures.
+func downloadMedia(ctx context.Context, log *logger.Logger, msg whapp.Message) (path string, err error) {
+	defer func() {
+		if err != nil && err != whapp.ErrMediaTooLarge && ctx.Err() == nil {
+			mediaDownloadFailures.Inc()
+		}
+	}()
+
+	for i := 0; i < mediaDownloadTries; i++ {
+		if i > 0 {
+			log.Warningf("downloaded media is corrupt, retrying (%d/%d)", i+1, mediaDownloadTries)
+			time.Sleep(time.Duration(i) * time.Second)
+		}
+
+		path, err = downloadMediaOnce(ctx, log, msg)
+		if err != whapp.ErrMediaCorrupt {
+			return path, err
+		}
+	}
+	return "", err
+}
+
+// readFileHeader returns the first bytes of the file at the given path, which
+// are used to detect its type.
+func readFileHeader(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return header[:n], nil
+}
+
+func downloadAndStoreMedia(ctx context.Context, log *logger.Logger, user string, msg whapp.Message) error {
+	if !msg.IsMMS {
+		return nil
+	} else if _, has := fs.GetFileByHash(user, msg.MediaFileHash); has {
+		return nil
+	}
+	log = log.With("media", msg.MediaFileHash)
+
+	// the blob may already be stored for another user, in that case we
+	// don't have to download it again.
+	info := getMediaInfo(msg)
+	if file, has, err := fs.Claim(user, msg.MediaFileHash, info); has {
+		if err != nil {
+			return err
+		}
+
+		if err := postProcessMedia(ctx, file, msg); err != nil {
+			log.Warningf("error while post-processing media: %s", err)
+		}
+		return nil
+	}
+
+	path, err := downloadMedia(ctx, log, msg)
+	if err != nil {
+		return err
+	}
+
+	header, err := readFileHeader(path)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	ext := getExtensionByMimeOrBytes(msg.MimeType, header)
+	if ext == "" {
+		ext = filepath.Ext(msg.MediaFilename)
+		if ext != "" {
+			ext = ext[1:]
+		}
+	}
+
+	file, err := fs.AddFile(
+		user,
+		msg.MediaFileHash,
+		ext,
+		path,
+		info,
+	)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	// post-processing is optional, so failing to do so shouldn't prevent the
+	// message from being delivered.
+	if err := postProcessMedia(ctx, file, msg); err != nil {
+		log.Warningf("error while post-processing media: %s", err)
+	}
+	return nil
+}
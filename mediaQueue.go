@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"whapp-irc/logger"
+	"whapp-irc/whapp"
+)
+
+// MediaQueue downloads the media of messages in the background, so that
+// messages don't have to wait until the media of earlier messages has been
+// downloaded.
+type MediaQueue struct {
+	ctx  context.Context
+	user string
+	log  *logger.Logger
+
+	// sem limits the amount of concurrent downloads.
+	sem chan struct{}
+
+	mutex   sync.Mutex
+	pending map[string]int
+	// tooLarge contains the hashes of the last tooLargeMemory media which
+	// turned out to be too large while downloading it, since WhatsApp didn't
+	// tell us its size.
+	tooLarge *messageIDSet
+}
+
+// tooLargeMemory is the amount of hashes of too large media a MediaQueue
+// remembers. Forgotten media is downloaded again when it's sent again, which
+// fails the same way.
+const tooLargeMemory = 256
+
+// MakeMediaQueue makes a new MediaQueue storing media for the given user,
+// downloading at most `concurrency` files at the same time.
+func MakeMediaQueue(ctx context.Context, user string, log *logger.Logger, concurrency int) *MediaQueue {
+	return &MediaQueue{
+		ctx:  ctx,
+		user: user,
+		log:  log,
+
+		sem: make(chan struct{}, concurrency),
+
+		pending:  make(map[string]int),
+		tooLarge: makeMessageIDSet(tooLargeMemory),
+	}
+}
+
+// NeedsDownload returns whether or not the media of the given message still has
+// to be downloaded and stored.
+func (q *MediaQueue) NeedsDownload(msg whapp.Message) bool {
+	if !msg.IsMMS || getConfig().MediaDownloadOptions.ExceedsMaxSize(msg.MediaData.Size) {
+		return false
+	}
+
+	_, has := fs.GetFileByHash(q.user, msg.MediaFileHash)
+	return !has
+}
+
+// IsTooLarge returns whether or not the media with the given hash turned out to
+// be too large to download.
+func (q *MediaQueue) IsTooLarge(hash string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.tooLarge.has(hash)
+}
+
+// IsPending returns whether or not the media with the given hash is currently
+// being downloaded.
+func (q *MediaQueue) IsPending(hash string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.pending[hash] > 0
+}
+
+func (q *MediaQueue) setPending(hash string, pending bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if pending {
+		q.pending[hash]++
+	} else if q.pending[hash]--; q.pending[hash] <= 0 {
+		delete(q.pending, hash)
+	}
+}
+
+// Enqueue marks the media of the given message as pending and downloads it in
+// the background once start is closed, after which done is called with the
+// result.
+func (q *MediaQueue) Enqueue(msg whapp.Message, start <-chan struct{}, done func(err error)) {
+	q.setPending(msg.MediaFileHash, true)
+
+	go func() {
+		select {
+		case <-q.ctx.Done():
+			q.setPending(msg.MediaFileHash, false)
+			return
+		case <-start:
+		}
+
+		select {
+		case <-q.ctx.Done():
+			q.setPending(msg.MediaFileHash, false)
+			return
+		case q.sem <- struct{}{}:
+		}
+
+		err := q.Download(msg)
+		<-q.sem
+
+		q.setPending(msg.MediaFileHash, false)
+		done(err)
+	}()
+}
+
+// Download downloads and stores the media of the given message right away.
+func (q *MediaQueue) Download(msg whapp.Message) error {
+	err := downloadAndStoreMedia(q.ctx, q.log, q.user, msg)
+	if err == whapp.ErrMediaTooLarge {
+		// the message will be sent with a placeholder instead.
+		q.log.With("media", msg.MediaFileHash).Infof("not downloading media: %s", err)
+
+		q.mutex.Lock()
+		q.tooLarge.add(msg.MediaFileHash)
+		q.mutex.Unlock()
+		return nil
+	}
+	return err
+}
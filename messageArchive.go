@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"whapp-irc/archive"
+	"whapp-irc/maps"
+	"whapp-irc/whapp"
+)
+
+// getArchiveBody returns the text of the given message to store in the
+// archive, the media itself is stored as a reference.
+func getArchiveBody(msg whapp.Message, participants []Participant, ownName string, mapProvider maps.Provider) string {
+	whappParticipants := make([]whapp.Participant, len(participants))
+	for i, p := range participants {
+		whappParticipants[i] = whapp.Participant(p)
+	}
+
+	if msg.Location != nil {
+		return maps.ByProvider(
+			mapProvider,
+			msg.Location.Latitude,
+			msg.Location.Longitude,
+		)
+	} else if msg.IsMMS {
+		return msg.FormatCaption(whappParticipants, ownName)
+	}
+
+	return msg.FormatBody(whappParticipants, ownName)
+}
+
+// makeArchiveMessage converts the given message, which has been sent or
+// received in the given chat, to a message stored in the archive.
+func (conn *Connection) makeArchiveMessage(chat *Chat, msg whapp.Message) archive.Message {
+	sender := conn.irc.Nick()
+	if !msg.IsSentByMe && msg.Sender != nil {
+		p := formatContact(*msg.Sender)
+		sender = p.SafeName()
+	}
+
+	item := archive.Message{
+		ID:        msg.ID.Serialized,
+		Timestamp: msg.Timestamp,
+		Chat:      chat.ID.String(),
+		Sender:    sender,
+		FromMe:    msg.IsSentByMe,
+		Type:      msg.Type,
+		Body:      getArchiveBody(msg, chat.Participants, conn.me.Pushname, conn.settings().MapProvider),
+	}
+	if msg.IsMMS {
+		item.MediaHash = msg.MediaFileHash
+	}
+	if msg.QuotedMessageObject != nil {
+		item.QuotedID = msg.QuotedMessageObject.ID.Serialized
+	}
+	return item
+}
+
+// archiveMessage stores the given message, which has been sent or received in
+// the given chat, in the message archive.
+func (conn *Connection) archiveMessage(chat *Chat, msg whapp.Message) {
+	if messageArchive == nil || msg.IsNotification {
+		return
+	}
+
+	item := conn.makeArchiveMessage(chat, msg)
+	if err := messageArchive.Add(conn.irc.Nick(), item); err != nil {
+		conn.log().With("chat", chat.Identifier()).Errorf("error while archiving message: %s", err)
+	}
+}
+
+// mediaURLs returns a function returning the URL of the media of the given
+// user with the given hash.
+func mediaURLs(user string) archive.MediaURLFunc {
+	return func(hash string) string {
+		if f, has := fs.GetFileByHash(user, hash); has {
+			return f.URL
+		}
+		return ""
+	}
+}
+
+// archivedMessageBody returns the body of the given archived message, including
+// the URL of its media.
+func (conn *Connection) archivedMessageBody(msg archive.Message) string {
+	body := msg.Body
+	if msg.MediaHash != "" {
+		media := mediaURLs(conn.irc.Nick())(msg.MediaHash)
+		if media == "" {
+			media = "--file--"
+		}
+
+		if body == "" {
+			body = media
+		} else {
+			body = media + " " + body
+		}
+	}
+
+	return body
+}
+
+// formatArchivedMessage formats the given archived message as a single line.
+func (conn *Connection) formatArchivedMessage(msg archive.Message) string {
+	body := strings.Replace(conn.archivedMessageBody(msg), "\n", " ", -1)
+
+	return fmt.Sprintf(
+		"[%s] <%s> %s",
+		msg.Time().Format("2006-01-02 15:04"),
+		msg.Sender,
+		body,
+	)
+}
@@ -0,0 +1,108 @@
+package main
+
+import "sync"
+
+// messageIDSet is a bounded set of message IDs, or other strings such as media
+// hashes. When it's full the oldest ID is removed when adding a new one.
+type messageIDSet struct {
+	ring []string
+	next int
+	set  map[string]struct{}
+}
+
+func makeMessageIDSet(size int) *messageIDSet {
+	return &messageIDSet{
+		ring: make([]string, 0, size),
+		set:  make(map[string]struct{}, size),
+	}
+}
+
+func (s *messageIDSet) add(id string) (added bool) {
+	if _, has := s.set[id]; has {
+		return false
+	}
+
+	if len(s.ring) < cap(s.ring) {
+		s.ring = append(s.ring, id)
+	} else {
+		delete(s.set, s.ring[s.next])
+		s.ring[s.next] = id
+		s.next = (s.next + 1) % len(s.ring)
+	}
+
+	s.set[id] = struct{}{}
+	return true
+}
+
+func (s *messageIDSet) has(id string) bool {
+	_, has := s.set[id]
+	return has
+}
+
+// list returns the IDs in the set, from oldest to newest.
+func (s *messageIDSet) list() []string {
+	res := make([]string, 0, len(s.ring))
+	res = append(res, s.ring[s.next:]...)
+	return append(res, s.ring[:s.next]...)
+}
+
+// MessageIDMap keeps track of the IDs of the messages that have been handled
+// per chat, so that messages aren't delivered twice.
+type MessageIDMap struct {
+	mutex sync.Mutex
+	size  int
+	m     map[string]*messageIDSet
+}
+
+// MakeMessageIDMap makes a new MessageIDMap which remembers at most `size`
+// message IDs per chat.
+func MakeMessageIDMap(size int) *MessageIDMap {
+	return &MessageIDMap{
+		size: size,
+		m:    make(map[string]*messageIDSet),
+	}
+}
+
+// Add marks the message with the given id in the chat with the given chatID as
+// handled. It returns false if the message was already handled.
+func (mm *MessageIDMap) Add(chatID, id string) (added bool) {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+
+	set, has := mm.m[chatID]
+	if !has {
+		set = makeMessageIDSet(mm.size)
+		mm.m[chatID] = set
+	}
+
+	return set.add(id)
+}
+
+// GetCopy returns a copy of the handled message IDs per chat, from oldest to
+// newest.
+func (mm *MessageIDMap) GetCopy() map[string][]string {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+
+	res := make(map[string][]string, len(mm.m))
+	for chatID, set := range mm.m {
+		res[chatID] = set.list()
+	}
+	return res
+}
+
+// Swap replaces the handled message IDs with the given ones, as returned by
+// GetCopy.
+func (mm *MessageIDMap) Swap(m map[string][]string) {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+
+	mm.m = make(map[string]*messageIDSet, len(m))
+	for chatID, ids := range m {
+		set := makeMessageIDSet(mm.size)
+		for _, id := range ids {
+			set.add(id)
+		}
+		mm.m[chatID] = set
+	}
+}
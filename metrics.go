@@ -0,0 +1,35 @@
+package main
+
+import "whapp-irc/metrics"
+
+// The directions of bridged messages, used as the direction label of
+// messagesBridged.
+const (
+	directionToIRC      = "whatsapp_to_irc"
+	directionToWhatsApp = "irc_to_whatsapp"
+)
+
+var (
+	ircClients = metrics.NewGaugeFunc(
+		"whapp_irc_irc_clients",
+		"The amount of connected IRC clients.",
+		func() float64 { return float64(connections.Len()) },
+	)
+	browserInstances = metrics.NewGauge(
+		"whapp_irc_browser_instances",
+		"The amount of running browser instances.",
+	)
+	messagesBridged = metrics.NewCounter(
+		"whapp_irc_messages_bridged_total",
+		"The amount of messages bridged, by direction and message type.",
+		"direction", "type",
+	)
+	mediaDownloadFailures = metrics.NewCounter(
+		"whapp_irc_media_download_failures_total",
+		"The amount of media downloads that failed, after retrying.",
+	)
+	sessionRecoveries = metrics.NewCounter(
+		"whapp_irc_session_recoveries_total",
+		"The amount of times WhatsApp Web was restarted after it failed.",
+	)
+)
@@ -0,0 +1,377 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the default upper bounds of histogram buckets, in
+// seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is a registered metric, which can write all of its series in the
+// Prometheus text format.
+type metric interface {
+	Name() string
+	write(w io.Writer)
+}
+
+var (
+	registryMutex sync.Mutex
+	registry      = make(map[string]metric)
+)
+
+// register registers the given metric, panicking when a metric with the same
+// name has already been registered.
+func register(m metric) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if _, has := registry[m.Name()]; has {
+		panic("metrics: metric registered twice: " + m.Name())
+	}
+	registry[m.Name()] = m
+}
+
+// Write writes all registered metrics to w in the Prometheus text format.
+func Write(w io.Writer) error {
+	registryMutex.Lock()
+	var metrics []metric
+	for _, m := range registry {
+		metrics = append(metrics, m)
+	}
+	registryMutex.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Name() < metrics[j].Name()
+	})
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler returns a http.Handler serving all registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w)
+	})
+}
+
+// desc contains the description of a metric.
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d desc) Name() string {
+	return d.name
+}
+
+func (d desc) writeHeader(w io.Writer) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help)
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// key returns the key of the series with the given label values, panicking
+// when the amount of values doesn't match the amount of labels.
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf(
+			"metrics: %s expects %d label values, got %d",
+			d.name,
+			len(d.labels),
+			len(values),
+		))
+	}
+	return strings.Join(values, "\xff")
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats the given labels and values as {a="b",c="d"}, extra is
+// appended to the labels, formatted as is.
+func formatLabels(names, values []string, extra string) string {
+	var parts []string
+	for i, name := range names {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, name, labelValueReplacer.Replace(values[i])))
+	}
+	if extra != "" {
+		parts = append(parts, extra)
+	}
+
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// series is a single value of a counter or gauge.
+type series struct {
+	values []string
+	value  float64
+}
+
+// seriesMap contains the series of a counter or gauge, by their label values.
+type seriesMap struct {
+	desc
+
+	m      sync.Mutex
+	series map[string]*series
+}
+
+func makeSeriesMap(d desc) *seriesMap {
+	return &seriesMap{
+		desc:   d,
+		series: make(map[string]*series),
+	}
+}
+
+func (s *seriesMap) update(values []string, fn func(float64) float64) {
+	key := s.key(values)
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	item, has := s.series[key]
+	if !has {
+		item = &series{values: append([]string(nil), values...)}
+		s.series[key] = item
+	}
+	item.value = fn(item.value)
+}
+
+func (s *seriesMap) write(w io.Writer) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.writeHeader(w)
+
+	// metrics without labels are exposed right away.
+	if len(s.labels) == 0 && len(s.series) == 0 {
+		fmt.Fprintf(w, "%s 0\n", s.name)
+		return
+	}
+
+	var keys []string
+	for key := range s.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		item := s.series[key]
+		fmt.Fprintf(
+			w,
+			"%s%s %s\n",
+			s.name,
+			formatLabels(s.labels, item.values, ""),
+			formatValue(item.value),
+		)
+	}
+}
+
+// A Counter is a value that only goes up, with a series per combination of
+// label values.
+type Counter struct {
+	*seriesMap
+}
+
+// NewCounter registers and returns a new Counter with the given name, help
+// text and label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{makeSeriesMap(desc{name, help, "counter", labels})}
+	register(c)
+	return c
+}
+
+// Add adds the given value, which can't be negative, to the series with the
+// given label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("metrics: counter " + c.name + " can't decrease")
+	}
+	c.update(labelValues, func(old float64) float64 { return old + v })
+}
+
+// Inc increments the series with the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// A Gauge is a value that can go up and down, with a series per combination
+// of label values.
+type Gauge struct {
+	*seriesMap
+}
+
+// NewGauge registers and returns a new Gauge with the given name, help text and
+// label names.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{makeSeriesMap(desc{name, help, "gauge", labels})}
+	register(g)
+	return g
+}
+
+// Set sets the series with the given label values to the given value.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.update(labelValues, func(float64) float64 { return v })
+}
+
+// Add adds the given value to the series with the given label values.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.update(labelValues, func(old float64) float64 { return old + v })
+}
+
+// Inc increments the series with the given label values.
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec decrements the series with the given label values.
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// A GaugeFunc is a gauge without labels whose value is retrieved when the
+// metrics are written.
+type GaugeFunc struct {
+	desc
+	fn func() float64
+}
+
+// NewGaugeFunc registers and returns a new GaugeFunc with the given name and
+// help text, fn is called to get its value.
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{desc{name, help, "gauge", nil}, fn}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.fn()))
+}
+
+// histogramSeries contains the observations of a single histogram series.
+type histogramSeries struct {
+	values []string
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// A Histogram counts observations in buckets, with a series per combination
+// of label values.
+type Histogram struct {
+	desc
+	buckets []float64
+
+	m      sync.Mutex
+	series map[string]*histogramSeries
+}
+
+// NewHistogram registers and returns a new Histogram with the given name, help
+// text, bucket upper bounds and label names.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	h := &Histogram{
+		desc:    desc{name, help, "histogram", labels},
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	register(h)
+	return h
+}
+
+// Observe adds the given value to the series with the given label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	item, has := h.series[key]
+	if !has {
+		item = &histogramSeries{
+			values: append([]string(nil), labelValues...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = item
+	}
+
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		item.counts[i]++
+	}
+	item.count++
+	item.sum += v
+}
+
+// ObserveSince adds the time passed since start in seconds to the series with
+// the given label values.
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	h.writeHeader(w)
+
+	series := h.series
+	if len(h.labels) == 0 && len(series) == 0 {
+		series = map[string]*histogramSeries{
+			"": {counts: make([]uint64, len(h.buckets))},
+		}
+	}
+
+	var keys []string
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		item := series[key]
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += item.counts[i]
+			le := fmt.Sprintf(`le="%s"`, formatValue(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, item.values, le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, item.values, `le="+Inf"`), item.count)
+
+		labels := formatLabels(h.labels, item.values, "")
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatValue(item.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, item.count)
+	}
+}
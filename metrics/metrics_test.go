@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	counter := NewCounter("test_events_total", "The amount of events.")
+	gauge := NewGauge("test_sessions", "The amount of sessions,\nby state.", "state")
+	histogram := NewHistogram("test_duration_seconds", "The duration of things.", []float64{1, 0.5})
+
+	counter.Inc()
+	counter.Add(2)
+	gauge.Set(3, "logged in")
+	gauge.Inc(`waiting "for" qr`)
+	gauge.Dec("logged in")
+	histogram.Observe(0.2)
+	histogram.Observe(0.5)
+	histogram.Observe(0.7)
+	histogram.Observe(3)
+
+	var buf bytes.Buffer
+	if err := Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_duration_seconds The duration of things.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.5"} 2
+test_duration_seconds_bucket{le="1"} 3
+test_duration_seconds_bucket{le="+Inf"} 4
+test_duration_seconds_sum 4.4
+test_duration_seconds_count 4
+# HELP test_events_total The amount of events.
+# TYPE test_events_total counter
+test_events_total 3
+# HELP test_sessions The amount of sessions,\nby state.
+# TYPE test_sessions gauge
+test_sessions{state="logged in"} 2
+test_sessions{state="waiting \"for\" qr"} 1
+`
+	if buf.String() != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
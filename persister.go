@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// A Persister saves state using a single goroutine, coalescing all requests to
+// save it made within an interval into a single save.
+type Persister struct {
+	save     func() error
+	interval time.Duration
+
+	dirtyCh chan struct{}
+	flushCh chan chan error
+	doneCh  chan struct{}
+}
+
+// MakePersister makes a new Persister which calls save at most once per
+// interval after the state has been marked dirty.
+// You have to call Run to start it.
+func MakePersister(save func() error, interval time.Duration) *Persister {
+	return &Persister{
+		save:     save,
+		interval: interval,
+
+		dirtyCh: make(chan struct{}, 1),
+		flushCh: make(chan chan error),
+		doneCh:  make(chan struct{}),
+	}
+}
+
+// Run saves the state whenever it's dirty, until the given context is done.
+// Dirty state is saved one last time before returning.
+func (p *Persister) Run(ctx context.Context) {
+	defer close(p.doneCh)
+
+	dirty := false
+	var timer <-chan time.Time
+
+	for {
+		select {
+		case <-p.dirtyCh:
+			if !dirty {
+				dirty = true
+				timer = time.After(p.interval)
+			}
+
+		case <-timer:
+			p.save()
+			dirty = false
+			timer = nil
+
+		case ch := <-p.flushCh:
+			ch <- p.save()
+			dirty = false
+			timer = nil
+
+		case <-ctx.Done():
+			select {
+			case <-p.dirtyCh:
+				dirty = true
+			default:
+			}
+
+			if dirty {
+				p.save()
+			}
+			return
+		}
+	}
+}
+
+// MarkDirty marks the state as dirty, so that it will be saved soon.
+func (p *Persister) MarkDirty() {
+	select {
+	case p.dirtyCh <- struct{}{}:
+	default:
+		// already marked dirty.
+	}
+}
+
+// Flush saves the state right away, and returns the error that occurred while
+// saving, if any.
+func (p *Persister) Flush() error {
+	ch := make(chan error, 1)
+
+	select {
+	case p.flushCh <- ch:
+		return <-ch
+	case <-p.doneCh:
+		return p.save()
+	}
+}
+
+// Done returns a channel that's closed when the persister has stopped, after
+// saving any dirty state.
+func (p *Persister) Done() <-chan struct{} {
+	return p.doneCh
+}
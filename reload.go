@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"whapp-irc/config"
+	"whapp-irc/logger"
+)
+
+// currentConfig contains the current config.Config, which is replaced when the
+// configuration is reloaded.
+var currentConfig atomic.Value
+
+// getConfig returns the current configuration.
+// Only the settings applied by applyConfig change when the configuration is
+// reloaded, the others are read once at startup.
+func getConfig() config.Config {
+	return currentConfig.Load().(config.Config)
+}
+
+// applyConfig makes the given configuration the current one, and applies the
+// settings which can be changed while running.
+func applyConfig(cfg config.Config) {
+	currentConfig.Store(cfg)
+
+	log := logger.Default()
+	log.SetLevel(cfg.LogLevel)
+	log.SetFormat(cfg.LogFormat)
+	log.SetEnabled(logger.CDPTraffic, cfg.LogCDPTraffic)
+	log.SetEnabled(logger.IRCTraffic, cfg.LogIRCTraffic)
+	log.SetEnabled(logger.MessageContents, cfg.LogMessageContents)
+
+	if chatLogger != nil {
+		chatLogger.SetRetention(cfg.ChatLogMaxSize, cfg.ChatLogKeep)
+	}
+}
+
+// restartRequired returns the names of the settings which differ between the
+// given configurations, but can only be changed by restarting whapp-irc.
+func restartRequired(old, new config.Config) []string {
+	var res []string
+	check := func(name string, changed bool) {
+		if changed {
+			res = append(res, name)
+		}
+	}
+
+	check("irc.port", old.IRCPort != new.IRCPort)
+	check("fileserver.host", old.FileServerHost != new.FileServerHost)
+	check("fileserver.port", old.FileServerPort != new.FileServerPort)
+	check("fileserver.https", old.FileServerHTTPS != new.FileServerHTTPS)
+	check("admin.host", old.AdminHost != new.AdminHost)
+	check("admin.port", old.AdminPort != new.AdminPort)
+	check("browser.headless", old.BrowserHeadless != new.BrowserHeadless)
+	check("logging.chat_log_path", old.ChatLogPath != new.ChatLogPath)
+	check("storage.backend", old.DatabaseBackend != new.DatabaseBackend)
+	check("storage.path", old.DatabasePath != new.DatabasePath)
+	check("storage.secret", old.DatabaseSecret != new.DatabaseSecret)
+	check("storage.archive", old.ArchiveMessages != new.ArchiveMessages)
+	check("storage.archive_path", old.ArchivePath != new.ArchivePath)
+	return res
+}
+
+// reloadConfig reads the configuration again using the given command line
+// arguments, and applies the settings which can be changed while running.
+// It returns the names of the changed settings which require a restart.
+func reloadConfig(args []string) (restart []string, err error) {
+	cfg, _, err := config.Load(args)
+	if err != nil {
+		return nil, err
+	}
+
+	old := getConfig()
+	restart = restartRequired(old, cfg)
+	applyConfig(cfg)
+
+	if old.LogLevel != cfg.LogLevel {
+		logger.Default().Infof("log level changed from %s to %s", old.LogLevel, cfg.LogLevel)
+	}
+	return restart, nil
+}
+
+// watchReloadSignal reloads the configuration every time the process receives
+// SIGHUP.
+func watchReloadSignal(args []string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+
+	for range ch {
+		restart, err := reloadConfig(args)
+		if err != nil {
+			logger.Default().Errorf("error while reloading configuration, keeping the current one:\n%s", err)
+			continue
+		}
+
+		msg := "configuration reloaded"
+		if len(restart) > 0 {
+			msg = fmt.Sprintf(
+				"%s, changes to %s only take effect after a restart",
+				msg,
+				strings.Join(restart, ", "),
+			)
+		}
+		logger.Default().Infof("%s", msg)
+	}
+}
+
+// settings returns the current settings of the user of the current connection.
+func (conn *Connection) settings() config.UserSettings {
+	return getConfig().Users.Get(conn.irc.Nick())
+}
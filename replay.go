@@ -3,11 +3,11 @@ package main
 import "whapp-irc/whapp"
 
 func (conn *Connection) hasReplay() bool {
-	return conn.irc.Caps.Has("whapp-irc/replay") || alternativeReplay
+	return conn.irc.Caps.Has("whapp-irc/replay") || conn.settings().AlternativeReplay
 }
 
 func (conn *Connection) handleWhappMessageReplay(msg whapp.Message) error {
-	if alternativeReplay {
+	if conn.settings().AlternativeReplay {
 		return conn.alternativeReplayWhappMessageHandle(msg)
 	}
 
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	// errReconnect is returned by runSession when the session stopped because
+	// the user asked to reconnect.
+	errReconnect = errors.New("reconnect requested")
+
+	// errReset is returned by runSession when the session stopped because the
+	// user asked to log out and log in again.
+	errReset = errors.New("reset requested")
+
+	// errLogout is returned by runSession when the session stopped because the
+	// user asked to log out.
+	errLogout = errors.New("logout requested")
+
+	// errLoggedOut is returned by runSession when the session stopped because
+	// the user unlinked the bridge using their phone.
+	errLoggedOut = errors.New("logged out of whatsapp")
+
+	// errSessionEnded is returned by runSession when the session stopped by
+	// itself.
+	errSessionEnded = errors.New("whatsapp session ended")
+)
+
+// setupError is returned by runSession when setting up the bridge failed.
+type setupError struct {
+	err error
+}
+
+func (e setupError) Error() string {
+	return "error while setting up: " + e.err.Error()
+}
+
+// A SessionRequest is a request of the user to stop the current session.
+type SessionRequest int
+
+const (
+	// RequestReconnect starts a new session using the stored session.
+	RequestReconnect SessionRequest = iota
+	// RequestReset logs out of WhatsApp Web, removes the stored state of the
+	// user and starts a new session, which logs in using a new QR code.
+	RequestReset
+	// RequestLogout logs out of WhatsApp Web, removes the stored state of the
+	// user and ends the connection.
+	RequestLogout
+)
+
+// err returns the error returned by runSession when the session stopped
+// because of the current request.
+func (r SessionRequest) err() error {
+	switch r {
+	case RequestReset:
+		return errReset
+	case RequestLogout:
+		return errLogout
+	default:
+		return errReconnect
+	}
+}
+
+func init() {
+	registerStatusCommand(StatusCommand{
+		Name: "reconnect",
+		Help: "restarts WhatsApp Web, logging in using the stored session",
+		Run: func(conn *Connection, args []string) error {
+			return conn.requestSession(RequestReconnect)
+		},
+	})
+
+	registerStatusCommand(StatusCommand{
+		Name: "reset",
+		Help: "logs out of WhatsApp, removes your data and sends a new QR code to log in with",
+		Run: func(conn *Connection, args []string) error {
+			return conn.requestSession(RequestReset)
+		},
+	})
+
+	registerStatusCommand(StatusCommand{
+		Name: "logout",
+		Help: "logs out of WhatsApp, removes your data and disconnects",
+		Run: func(conn *Connection, args []string) error {
+			return conn.requestSession(RequestLogout)
+		},
+	})
+}
+
+// SessionState is the state of the WhatsApp session of a connection, which is
+// replaced when reconnecting.
+type SessionState struct {
+	m       sync.RWMutex
+	ready   bool
+	readyCh chan struct{} // closed when the session is ready
+
+	requestCh chan SessionRequest
+}
+
+// MakeSessionState makes a new SessionState without a session.
+func MakeSessionState() *SessionState {
+	return &SessionState{
+		readyCh:   make(chan struct{}),
+		requestCh: make(chan SessionRequest, 1),
+	}
+}
+
+// Request asks the connection to stop the current session and handle the
+// given request. It returns false when another request hasn't been handled
+// yet.
+func (s *SessionState) Request(req SessionRequest) bool {
+	select {
+	case s.requestCh <- req:
+		return true
+	default:
+		return false
+	}
+}
+
+// requestSession makes the given request, and tells the user when it can't be
+// made.
+func (conn *Connection) requestSession(req SessionRequest) error {
+	if !conn.session.Request(req) {
+		return conn.irc.Status("busy handling another request, try again later")
+	}
+	return nil
+}
+
+// sessionReady returns whether or not the session is set up.
+func (conn *Connection) sessionReady() bool {
+	conn.session.m.RLock()
+	defer conn.session.m.RUnlock()
+	return conn.session.ready
+}
+
+// withSession runs fn when the session is set up, while making sure the
+// session isn't stopped until fn returns. ok is false when there's no session.
+func (conn *Connection) withSession(fn func() error) (ok bool, err error) {
+	conn.session.m.RLock()
+	defer conn.session.m.RUnlock()
+
+	if !conn.session.ready {
+		return false, nil
+	}
+	return true, fn()
+}
+
+// waitSession waits until the session is set up and runs fn, while making sure
+// the session isn't stopped until fn returns. fn isn't run when ctx is done
+// first.
+func (conn *Connection) waitSession(ctx context.Context, fn func() error) error {
+	for {
+		conn.session.m.RLock()
+		readyCh := conn.session.readyCh
+		conn.session.m.RUnlock()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-readyCh:
+		}
+
+		if ok, err := conn.withSession(fn); ok {
+			return err
+		}
+	}
+}
+
+// setSessionReady sets whether or not the session is set up. This waits until
+// every function run using withSession has returned.
+func (conn *Connection) setSessionReady(ready bool) {
+	conn.session.m.Lock()
+	defer conn.session.m.Unlock()
+
+	if ready == conn.session.ready {
+		return
+	}
+
+	conn.session.ready = ready
+	if ready {
+		close(conn.session.readyCh)
+	} else {
+		conn.session.readyCh = make(chan struct{})
+	}
+}
+
+// maxRecoveryAttempts is the amount of times in a row whapp-irc tries to start
+// WhatsApp Web again after it failed, before giving up.
+const maxRecoveryAttempts = 5
+
+// recoveryDelay returns the delay before the given attempt to start WhatsApp
+// Web again, which doubles every attempt up to a minute.
+func recoveryDelay(attempt int) time.Duration {
+	delay := time.Second << uint(attempt-1)
+	if delay > time.Minute {
+		delay = time.Minute
+	}
+	return delay
+}
+
+// runSessions runs WhatsApp sessions until ctx is done or the user logs out. A
+// new session is started every time the user reconnects, resets or unlinks the
+// bridge using their phone, and when the current session fails.
+func (conn *Connection) runSessions(ctx context.Context) error {
+	first := true
+	attempts := 0 // the amount of failed attempts to recover in a row
+
+	for {
+		ready, err := conn.runSession(ctx, first)
+		if ctx.Err() != nil {
+			return nil
+		} else if ready {
+			first = false
+			attempts = 0
+		}
+
+		if _, ok := err.(setupError); ok && (attempts == 0 || attempts >= maxRecoveryAttempts) {
+			attempts = 0
+
+			// keep the IRC connection, so the user can try again or start
+			// over.
+			conn.irc.Status("send reconnect to try again, or reset to log in using a new QR code")
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case req := <-conn.session.requestCh:
+				err = req.err()
+			}
+		}
+
+		switch err {
+		case errReconnect:
+			// make sure the next session starts with the current state.
+			if err := conn.persister.Flush(); err != nil {
+				return err
+			}
+			conn.irc.Status("reconnecting to whatsapp")
+
+		case errLoggedOut:
+			if err := conn.removeCredentials(); err != nil {
+				return err
+			}
+			conn.irc.Status("logged out of whatsapp, removed the stored session")
+
+		case errReset:
+			if err := conn.removeUserState(); err != nil {
+				return err
+			}
+			conn.irc.Status("logged out of whatsapp and removed your data")
+
+		case errLogout:
+			if err := conn.removeUserState(); err != nil {
+				return err
+			}
+			conn.irc.Status("logged out of whatsapp and removed your data, goodbye")
+			conn.irc.WriteNow("ERROR :Closing Link: whapp-irc (logged out)")
+			return errSessionEnded
+
+		default:
+			// WhatsApp Web crashed or stopped responding, start it again
+			// using the stored session.
+			attempts++
+			sessionRecoveries.Inc()
+
+			delay := recoveryDelay(attempts)
+			conn.log().Warningf("whatsapp session failed, restarting it in %s: %s", delay, err)
+			conn.irc.Status(fmt.Sprintf("lost connection to whatsapp web, restarting it in %s", delay))
+
+			if err := conn.persister.Flush(); err != nil {
+				return err
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(delay):
+			}
+		}
+	}
+}
+
+// runSession sets up the bridge and bridges messages until ctx is done, the
+// session stops by itself, or the user makes a request. ready is whether the
+// session has been set up. first is whether this is the first session of the
+// connection, later sessions send the messages received in between to the
+// user even when they don't want a replay.
+func (conn *Connection) runSession(ctx context.Context, first bool) (ready bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the reason the session stopped, if it's known.
+	reasonCh := make(chan error, 1)
+	setReason := func(err error) {
+		select {
+		case reasonCh <- err:
+		default:
+			// the first reason wins
+		}
+	}
+	reason := func(err error) error {
+		select {
+		case res := <-reasonCh:
+			return res
+		default:
+			return err
+		}
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case req := <-conn.session.requestCh:
+			setReason(req.err())
+			if req != RequestReconnect {
+				conn.unlink(ctx)
+			}
+			cancel()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		conn.setSessionReady(false)
+		wg.Wait()
+		conn.health.LoggedOut()
+		conn.bridge.Stop()
+	}()
+
+	if err := conn.setup(ctx, cancel); err != nil {
+		if r := reason(nil); r != nil {
+			return false, r
+		}
+		conn.log().Errorf("error while setting up: %s", err)
+		conn.irc.Status("erroring setting up whapp bridge: " + err.Error())
+		return false, setupError{err}
+	}
+	conn.setSessionReady(true)
+	ready = true
+
+	// we want to wait until we've finished negotiation, since when we send a
+	// replay we want to know if the user has servertime and even if they want a
+	// replay at all.
+	// if negotiation hasn't started yet, we just skip through (we figure the
+	// client doesn't support IRCv3, since normally negotiation occurs fairly
+	// early in the connection)
+	started, ok := conn.irc.Caps.WaitNegotiation(ctx)
+	if !ok {
+		return ready, reason(errSessionEnded)
+	} else if !started {
+		conn.log().Infof(
+			"IRCv3 capabilities negotiation has not started, " +
+				"this is probably a non IRCv3 compatible client.",
+		)
+	}
+
+	if err := conn.replayMissedMessages(!first); err != nil {
+		return ready, reason(err)
+	}
+
+	conn.irc.Status("ready for new messages")
+
+	// handle logging out on whatsapp web, this happens when the user removes
+	// the bridge client on their phone.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer cancel()
+
+		resCh, errCh := conn.bridge.WI.ListenLoggedIn(conn.bridge.ctx, time.Second)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case err := <-errCh:
+				conn.log().Errorf("error while listening for whatsapp loggedin state: %s", err)
+				return
+
+			case res := <-resCh:
+				if res {
+					continue
+				}
+
+				conn.health.LoggedOut()
+				setReason(errLoggedOut)
+				return
+			}
+		}
+	}()
+
+	// keep track of whether the phone is connected, this is only used to
+	// report the health of the session.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		resCh, errCh := conn.bridge.WI.ListenForPhoneActiveChange(
+			conn.bridge.ctx,
+			phoneActiveInterval,
+		)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case err := <-errCh:
+				if err != nil {
+					conn.log().Warningf("error while listening for phone activity: %s", err)
+				}
+				return
+
+			case res, ok := <-resCh:
+				if !ok {
+					return
+				}
+				conn.health.SetPhoneActive(res)
+			}
+		}
+	}()
+
+	// listen for new WhatsApp messages
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer cancel()
+
+		// TODO: a bridge should have closer grasp of whatever messages
+		// should be sent. Currently a bridge is loosly defined of whatever it
+		// does. The struct itself should provide more functions, and we
+		// should do less. In a prefect world, WI isn't exposed.
+		messageCh, errCh := conn.bridge.WI.ListenForMessages(
+			conn.bridge.ctx,
+			500*time.Millisecond,
+		)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case err := <-errCh:
+				conn.log().Errorf("error while listening for whatsapp messages: %s", err)
+				return
+
+			case msg := <-messageCh:
+				if err := conn.handleWhappMessage(msg); err != nil {
+					conn.log().With("chat", msg.Chat.ID.String()).Errorf("error handling new whapp message: %s", err)
+					continue
+				}
+			}
+		}
+	}()
+
+	<-ctx.Done()
+	return ready, reason(errSessionEnded)
+}
+
+// replayMissedMessages sends the messages received since the last received
+// message of every chat to the user, if they want a replay or force is true.
+func (conn *Connection) replayMissedMessages(force bool) error {
+	conn.m.RLock()
+	chats := make([]ChatListItem, len(conn.chats))
+	copy(chats, conn.chats)
+	conn.m.RUnlock()
+
+	empty := conn.timestampMap.Length() == 0
+	for _, item := range chats {
+		c := item.chat
+		if c == nil {
+			// the chat doesn't exist anymore in WhatsApp Web.
+			continue
+		}
+
+		prevTimestamp, found := conn.timestampMap.Get(c.ID.String())
+
+		if empty || !(force || conn.hasReplay()) {
+			conn.timestampMap.Set(c.ID.String(), c.rawChat.Timestamp)
+			conn.persister.MarkDirty()
+			continue
+		} else if c.rawChat.Timestamp <= prevTimestamp {
+			continue
+		}
+
+		if !found {
+			// fetch all older messages
+			prevTimestamp = math.MinInt64
+		}
+
+		messages, err := c.rawChat.GetMessagesFromChatTillDate(
+			conn.bridge.ctx,
+			conn.bridge.WI,
+			prevTimestamp,
+		)
+		if err != nil {
+			conn.log().With("chat", item.Identifier).Errorf("error while loading earlier messages: %s", err)
+			return err
+		}
+
+		for _, msg := range messages {
+			if msg.Timestamp <= prevTimestamp {
+				continue
+			}
+
+			if err := conn.handleWhappMessageReplay(msg); err != nil {
+				conn.log().With("chat", item.Identifier).Errorf("error handling older whapp message: %s", err)
+				continue
+			}
+		}
+	}
+
+	return nil
+}
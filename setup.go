@@ -3,36 +3,52 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
 	"sync"
 	"whapp-irc/whapp"
-
-	qrcode "github.com/skip2/go-qrcode"
 )
 
-// TODO: check if already set-up
-func (conn *Connection) setup(cancel context.CancelFunc) error {
-	if _, err := conn.bridge.Start(); err != nil {
+// setup starts the bridge and logs in to WhatsApp Web, using the stored session
+// if there is one. The bridge is stopped when ctx is done, when the bridge
+// stops by itself cancel is called.
+func (conn *Connection) setup(ctx context.Context, cancel context.CancelFunc) error {
+	if !conn.encrypted {
+		conn.irc.Status("no server secret or IRC password set, your session will be stored unencrypted")
+	}
+
+	// if we have the current user in the database, try to relogin using the
+	// previous localStorage state.
+	// the user is loaded before starting the bridge, so we don't start a
+	// browser when the stored user can't be decrypted.
+	var user User
+	found, err := conn.db.GetItem(conn.irc.Nick(), &user)
+	if err != nil {
+		return describeKeyError(err)
+	} else if found {
+		// the chat state is only loaded by the first session, sessions
+		// started by reconnecting continue with the state in memory.
+		conn.m.Lock()
+		if !conn.stateLoaded {
+			conn.timestampMap.Swap(user.LastReceivedReceipts)
+			conn.messageIDs.Swap(user.MessageIDs)
+			conn.chats = user.Chats
+		}
+		conn.m.Unlock()
+	}
+
+	if _, err := conn.bridge.Start(ctx, conn.log()); err != nil {
 		return err
 	}
 
+	bridgeCtx := conn.bridge.ctx
 	go func() {
 		// this is actually kind rough, but it seems to work better
 		// currently...
-		<-conn.bridge.ctx.Done()
+		<-bridgeCtx.Done()
 		cancel()
 	}()
 
-	// if we have the current user in the database, try to relogin using the
-	// previous localStorage state
-	var user User
-	found, err := userDb.GetItem(conn.irc.Nick(), &user)
-	if err != nil {
-		return err
-	} else if found {
-		conn.timestampMap.Swap(user.LastReceivedReceipts)
-		conn.chats = user.Chats
-
+	// the stored session is removed when the user logs out.
+	if len(user.LocalStorage) > 0 {
 		conn.irc.Status("logging in using stored session")
 
 		if err := conn.bridge.WI.Navigate(conn.bridge.ctx); err != nil {
@@ -42,7 +58,7 @@ func (conn *Connection) setup(cancel context.CancelFunc) error {
 			conn.bridge.ctx,
 			user.LocalStorage,
 		); err != nil {
-			log.Printf("error while setting local storage: %s\n", err.Error())
+			conn.log().Warningf("error while setting local storage: %s", err)
 		}
 	}
 
@@ -54,27 +70,8 @@ func (conn *Connection) setup(cancel context.CancelFunc) error {
 
 	// if we aren't logged in yet we have to get the QR code and stuff
 	if state == whapp.Loggedout {
-		code, err := conn.bridge.WI.GetLoginCode(conn.bridge.ctx)
-		if err != nil {
-			return fmt.Errorf("Error while retrieving login code: %s", err.Error())
-		}
-
-		bytes, err := qrcode.Encode(code, qrcode.High, 512)
-		if err != nil {
-			return err
-		}
-
-		qrFile, err := fs.AddBlob("qr-"+strTimestamp(), "png", bytes)
-		if err != nil {
-			return err
-		}
-		defer func() {
-			if err = fs.RemoveFile(qrFile); err != nil {
-				log.Printf("error while removing QR code: %s\n", err.Error())
-			}
-		}()
-
-		if err := conn.irc.Status("Scan this QR code: " + qrFile.URL); err != nil {
+		defer conn.finishLogin()
+		if err := conn.startLogin(conn.bridge.ctx, conn.bridge.WI); err != nil {
 			return err
 		}
 	}
@@ -84,14 +81,19 @@ func (conn *Connection) setup(cancel context.CancelFunc) error {
 		return err
 	}
 	conn.irc.Status("logged in")
+	conn.health.LoggedIn(conn.bridge.WI)
 
 	// get localstorage (that contains new login information), and save it to
 	// the database
-	conn.localStorage, err = conn.bridge.WI.GetLocalStorage(conn.bridge.ctx)
+	localStorage, err := conn.bridge.WI.GetLocalStorage(conn.bridge.ctx)
 	if err != nil {
-		log.Printf("error while getting local storage: %s\n", err.Error())
+		conn.log().Warningf("error while getting local storage: %s", err)
 	} else {
-		if err := conn.saveDatabaseEntry(); err != nil {
+		conn.m.Lock()
+		conn.localStorage = localStorage
+		conn.m.Unlock()
+
+		if err := conn.persister.Flush(); err != nil {
 			return err
 		}
 	}
@@ -121,7 +123,7 @@ func (conn *Connection) setup(cancel context.CancelFunc) error {
 			if err != nil {
 				str := fmt.Sprintf("error while converting chat with ID %s, skipping", raw.ID)
 				conn.irc.Status(str)
-				log.Printf("%s. error: %s", str, err)
+				conn.log().With("chat", raw.ID.String()).Warningf("%s. error: %s", str, err)
 				return
 			}
 
@@ -140,5 +142,9 @@ func (conn *Connection) setup(cancel context.CancelFunc) error {
 		conn.addChat(chat)
 	}
 
+	conn.m.Lock()
+	conn.stateLoaded = true
+	conn.m.Unlock()
+
 	return nil
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+	"whapp-irc/logger"
+)
+
+// shutdownTimeout is the maximum duration to wait for the connections to
+// shut down when whapp-irc is stopped.
+const shutdownTimeout = 15 * time.Second
+
+// shutdownNoticeTimeout is the maximum duration to wait for the shutdown notice
+// to be written to a client, so that clients which don't read can't delay
+// stopping their connection.
+const shutdownNoticeTimeout = 2 * time.Second
+
+// ConnectionRegistry keeps track of the active connections, so that they can
+// be shut down when whapp-irc is stopped.
+type ConnectionRegistry struct {
+	m       sync.Mutex
+	conns   map[*Connection]context.CancelFunc
+	closing bool
+	wg      sync.WaitGroup
+}
+
+// MakeConnectionRegistry makes a new empty ConnectionRegistry.
+func MakeConnectionRegistry() *ConnectionRegistry {
+	return &ConnectionRegistry{
+		conns: make(map[*Connection]context.CancelFunc),
+	}
+}
+
+// Add adds the given connection, which is stopped by calling cancel.
+// Returns false when the registry is shutting down, in which case the
+// connection isn't added.
+func (r *ConnectionRegistry) Add(conn *Connection, cancel context.CancelFunc) bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.closing {
+		return false
+	}
+
+	r.conns[conn] = cancel
+	r.wg.Add(1)
+	return true
+}
+
+// Remove removes the given connection, it should be called when the
+// connection has been completely stopped.
+func (r *ConnectionRegistry) Remove(conn *Connection) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if _, has := r.conns[conn]; !has {
+		return
+	}
+
+	delete(r.conns, conn)
+	r.wg.Done()
+}
+
+// Len returns the amount of active connections.
+func (r *ConnectionRegistry) Len() int {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return len(r.conns)
+}
+
+// Closing returns whether or not Shutdown has been called.
+func (r *ConnectionRegistry) Closing() bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.closing
+}
+
+// Shutdown tells every connection that whapp-irc is shutting down, stops them
+// and waits until they're stopped or the given timeout has passed.
+// No connections can be added after calling Shutdown.
+// Returns false if the timeout passed before every connection stopped.
+func (r *ConnectionRegistry) Shutdown(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	r.m.Lock()
+	r.closing = true
+	conns := make(map[*Connection]context.CancelFunc, len(r.conns))
+	for conn, cancel := range r.conns {
+		conns[conn] = cancel
+	}
+	r.m.Unlock()
+
+	for conn, cancel := range conns {
+		go func(conn *Connection, cancel context.CancelFunc) {
+			conn.sendShutdownNotice()
+			cancel()
+		}(conn, cancel)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// sendShutdownNotice tells the IRC client that whapp-irc is shutting down and
+// that the connection will be closed. It gives up after shutdownNoticeTimeout.
+func (conn *Connection) sendShutdownNotice() {
+	nick := conn.irc.Nick()
+	if nick == "" {
+		nick = "*"
+	}
+
+	if err := conn.irc.SetWriteDeadline(time.Now().Add(shutdownNoticeTimeout)); err != nil {
+		conn.log().Debugf("error while setting write deadline: %s", err)
+	}
+	conn.irc.WriteListNow([]string{
+		fmt.Sprintf(":whapp-irc NOTICE %s :whapp-irc is shutting down", nick),
+		"ERROR :Closing Link: whapp-irc (server shutting down)",
+	})
+}
+
+// waitForShutdownSignal blocks until the process receives SIGINT or SIGTERM,
+// and returns the received signal.
+// When a second signal is received the process is exited immediately.
+func waitForShutdownSignal() os.Signal {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-ch
+	go func() {
+		sig := <-ch
+		logger.Default().Warningf("received %s again, exiting immediately", sig)
+		os.Exit(1)
+	}()
+	return sig
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"whapp-irc/archive"
+	"whapp-irc/ircConnection"
+)
+
+// searchResultLimit is the maximum amount of results returned by the search
+// command, the most recent matches are returned.
+const searchResultLimit = 50
+
+// A StatusCommand is a command which can be sent to the status user.
+type StatusCommand struct {
+	// Name is the name of the command, as typed by the user.
+	Name string
+	// Args describes the arguments of the command, for example
+	// "<chat> [terms...]".
+	Args string
+	// Help is a short description of the command.
+	Help string
+
+	// MinArgs is the minimum amount of arguments, the usage is sent to the
+	// user when less arguments are given.
+	MinArgs int
+	// Session is whether or not the command needs a WhatsApp session.
+	Session bool
+
+	// Run runs the command with the given arguments.
+	Run func(conn *Connection, args []string) error
+}
+
+// Usage returns the usage of the command.
+func (cmd StatusCommand) Usage() string {
+	if cmd.Args == "" {
+		return "usage: " + cmd.Name
+	}
+	return "usage: " + cmd.Name + " " + cmd.Args
+}
+
+// statusCommands contains the commands which can be sent to the status user,
+// by name.
+var statusCommands = make(map[string]StatusCommand)
+
+// registerStatusCommand registers the given command, so it can be sent to the
+// status user.
+func registerStatusCommand(cmd StatusCommand) {
+	name := strings.ToLower(cmd.Name)
+	if _, has := statusCommands[name]; has {
+		panic("status command registered twice: " + name)
+	}
+	statusCommands[name] = cmd
+}
+
+func init() {
+	registerStatusCommand(StatusCommand{
+		Name: "help",
+		Args: "[command]",
+		Help: "lists the commands, or shows the usage of the given command",
+		Run: func(conn *Connection, args []string) error {
+			return conn.sendStatusHelp(args)
+		},
+	})
+
+	registerStatusCommand(StatusCommand{
+		Name:    "search",
+		Args:    "<chat> [since:YYYY-MM-DD] [until:YYYY-MM-DD] [terms...]",
+		Help:    "searches the archived messages of a chat",
+		MinArgs: 1,
+		Session: true,
+		Run: func(conn *Connection, args []string) error {
+			return conn.searchArchive(args[0], args[1:])
+		},
+	})
+
+	registerStatusCommand(StatusCommand{
+		Name:    "replay",
+		Args:    "<chat> [since:YYYY-MM-DD] [until:YYYY-MM-DD] [terms...]",
+		Help:    "sends the archived messages of a chat again",
+		MinArgs: 1,
+		Session: true,
+		Run: func(conn *Connection, args []string) error {
+			return conn.replayArchive(args[0], args[1:])
+		},
+	})
+
+	registerStatusCommand(StatusCommand{
+		Name:    "chats",
+		Args:    "[filter]",
+		Help:    "lists your chats, or the chats whose name contains filter",
+		Session: true,
+		Run: func(conn *Connection, args []string) error {
+			return conn.listChats(strings.Join(args, " "))
+		},
+	})
+
+	registerStatusCommand(StatusCommand{
+		Name:    "me",
+		Help:    "shows the WhatsApp account you're logged in with",
+		Session: true,
+		Run: func(conn *Connection, args []string) error {
+			return conn.sendMe()
+		},
+	})
+
+	registerStatusCommand(StatusCommand{
+		Name:    "phone",
+		Help:    "shows whether your phone is connected, and its battery level",
+		Session: true,
+		Run: func(conn *Connection, args []string) error {
+			return conn.sendPhoneStatus()
+		},
+	})
+
+	registerStatusCommand(StatusCommand{
+		Name: "settings",
+		Help: "shows your settings",
+		Run: func(conn *Connection, args []string) error {
+			return conn.sendSettings()
+		},
+	})
+}
+
+// handleStatusCommand handles the given message sent by the user to the status
+// user.
+func (conn *Connection) handleStatusCommand(body string) error {
+	status := conn.irc.Status
+
+	args, err := splitArgs(body)
+	if err != nil {
+		return status(err.Error())
+	} else if len(args) == 0 {
+		return nil
+	}
+
+	cmd, has := statusCommands[strings.ToLower(args[0])]
+	if !has {
+		return status("unknown command " + args[0] + ", send help for a list of commands")
+	}
+
+	args = args[1:]
+	if len(args) < cmd.MinArgs {
+		return status(cmd.Usage())
+	}
+
+	if !cmd.Session {
+		return cmd.Run(conn, args)
+	}
+
+	ok, err := conn.withSession(func() error {
+		return cmd.Run(conn, args)
+	})
+	if !ok {
+		return status("not connected to whatsapp yet, try again later")
+	}
+	return err
+}
+
+// splitArgs splits the given string into arguments separated by whitespace.
+// Arguments containing whitespace can be surrounded by double quotes.
+func splitArgs(str string) ([]string, error) {
+	var res []string
+	var cur strings.Builder
+	inArg := false
+	quoted := false
+
+	for _, r := range str {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+
+		case unicode.IsSpace(r) && !quoted:
+			if inArg {
+				res = append(res, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quoted {
+		return nil, fmt.Errorf("missing closing quote")
+	} else if inArg {
+		res = append(res, cur.String())
+	}
+	return res, nil
+}
+
+// sendStatusHelp sends the usage of the command named in args, or a list of
+// all commands, to the user.
+func (conn *Connection) sendStatusHelp(args []string) error {
+	status := conn.irc.Status
+
+	if len(args) > 0 {
+		cmd, has := statusCommands[strings.ToLower(args[0])]
+		if !has {
+			return status("unknown command " + args[0])
+		}
+
+		if err := status(cmd.Usage()); err != nil {
+			return err
+		}
+		return status(cmd.Help)
+	}
+
+	names := make([]string, 0, len(statusCommands))
+	for name := range statusCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if err := status("available commands:"); err != nil {
+		return err
+	}
+	for _, name := range names {
+		cmd := statusCommands[name]
+
+		str := cmd.Name
+		if cmd.Args != "" {
+			str += " " + cmd.Args
+		}
+		if err := status(fmt.Sprintf("  %s - %s", str, cmd.Help)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listChats sends the chats whose identifier or name contains filter to the
+// user, or all chats when filter is empty.
+func (conn *Connection) listChats(filter string) error {
+	status := conn.irc.Status
+	filter = strings.ToLower(filter)
+
+	conn.m.RLock()
+	chats := make([]ChatListItem, len(conn.chats))
+	copy(chats, conn.chats)
+	conn.m.RUnlock()
+
+	n := 0
+	for _, item := range chats {
+		c := item.chat
+		if c == nil {
+			continue
+		} else if filter != "" &&
+			!strings.Contains(strings.ToLower(item.Identifier), filter) &&
+			!strings.Contains(strings.ToLower(c.Name), filter) {
+			continue
+		}
+
+		var info []string
+		if c.IsGroupChat {
+			info = append(info, fmt.Sprintf(
+				"group, %d %s",
+				len(c.Participants),
+				plural(len(c.Participants), "participant", "participants"),
+			))
+		} else {
+			info = append(info, "private")
+		}
+		if c.Joined {
+			info = append(info, "joined")
+		}
+
+		str := fmt.Sprintf("%s (%s): %s", item.Identifier, c.Name, strings.Join(info, ", "))
+		if err := status(str); err != nil {
+			return err
+		}
+		n++
+	}
+
+	return status(fmt.Sprintf("%d %s", n, plural(n, "chat", "chats")))
+}
+
+// sendMe sends information about the WhatsApp account of the user to the user.
+func (conn *Connection) sendMe() error {
+	me := conn.me
+
+	lines := []string{
+		fmt.Sprintf("logged in as %s (%s)", me.Pushname, me.SelfID.User),
+		fmt.Sprintf("platform: %s, WhatsApp %s", me.Platform, me.Phone.WhatsAppVersion),
+	}
+	if me.Phone.DeviceManufacturer != "" || me.Phone.DeviceModel != "" {
+		lines = append(lines, fmt.Sprintf(
+			"phone: %s %s, OS %s",
+			me.Phone.DeviceManufacturer,
+			me.Phone.DeviceModel,
+			me.Phone.OsVersion,
+		))
+	}
+
+	for _, line := range lines {
+		if err := conn.irc.Status(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendPhoneStatus sends whether the phone of the user is connected, and its
+// battery level, to the user.
+func (conn *Connection) sendPhoneStatus() error {
+	status := conn.irc.Status
+
+	active, err := conn.bridge.WI.GetPhoneActive(conn.bridge.ctx)
+	if err != nil {
+		return status("error while checking phone: " + err.Error())
+	}
+	conn.health.SetPhoneActive(active)
+
+	if !active {
+		return status("your phone is not connected")
+	}
+
+	me, err := conn.bridge.WI.GetMe(conn.bridge.ctx)
+	if err != nil {
+		return status("your phone is connected")
+	}
+
+	charging := ""
+	if me.PluggedIn {
+		charging = ", charging"
+	}
+	return status(fmt.Sprintf(
+		"your phone is connected, battery at %d%%%s",
+		me.BatteryPercentage,
+		charging,
+	))
+}
+
+// sendSettings sends the settings of the user to the user.
+func (conn *Connection) sendSettings() error {
+	settings := conn.settings()
+
+	onOff := func(b bool) string {
+		if b {
+			return "on"
+		}
+		return "off"
+	}
+
+	lines := []string{
+		"map provider: " + settings.MapProvider.String(),
+		"alternative replay: " + onOff(settings.AlternativeReplay),
+		"transcode voice notes: " + onOff(settings.TranscodeVoiceNotes),
+		"replay: " + onOff(conn.hasReplay()),
+		"message archive: " + onOff(messageArchive != nil),
+		"chat logs: " + onOff(settings.ChatLogs),
+	}
+
+	for _, line := range lines {
+		if err := conn.irc.Status(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchArchive sends the archived messages in the chat with the given
+// identifier matching the query given as words to the user.
+func (conn *Connection) searchArchive(identifier string, words []string) error {
+	status := conn.irc.Status
+
+	if messageArchive == nil {
+		return status("the message archive is disabled")
+	}
+
+	item, has := conn.GetChatByIdentifier(identifier)
+	if !has {
+		return status("unknown chat " + identifier)
+	}
+
+	query, err := archive.ParseQuery(words)
+	if err != nil {
+		return status(err.Error())
+	}
+
+	messages, err := messageArchive.Find(conn.irc.Nick(), item.ID.String(), query)
+	if err != nil {
+		return status("error while searching: " + err.Error())
+	} else if len(messages) == 0 {
+		return status("no messages found")
+	}
+
+	if n := len(messages); n > searchResultLimit {
+		if err := status(fmt.Sprintf("found %d messages, showing the last %d", n, searchResultLimit)); err != nil {
+			return err
+		}
+		messages = messages[n-searchResultLimit:]
+	}
+
+	for _, msg := range messages {
+		if err := status(conn.formatArchivedMessage(msg)); err != nil {
+			return err
+		}
+	}
+	return status(fmt.Sprintf("end of search results for %s", item.Identifier))
+}
+
+// replayArchive sends the archived messages in the chat with the given
+// identifier matching the query given as words to the user, as messages in
+// that chat with their original time.
+func (conn *Connection) replayArchive(identifier string, words []string) error {
+	status := conn.irc.Status
+
+	if messageArchive == nil {
+		return status("the message archive is disabled")
+	}
+
+	item, has := conn.GetChatByIdentifier(identifier)
+	if !has || item.chat == nil {
+		return status("unknown chat " + identifier)
+	}
+
+	query, err := archive.ParseQuery(words)
+	if err != nil {
+		return status(err.Error())
+	}
+
+	messages, err := messageArchive.Find(conn.irc.Nick(), item.ID.String(), query)
+	if err != nil {
+		return status("error while replaying: " + err.Error())
+	} else if len(messages) == 0 {
+		return status("no messages found")
+	}
+
+	if item.chat.IsGroupChat {
+		if err := conn.joinChat(item); err != nil {
+			return status("error while joining: " + err.Error())
+		}
+	}
+
+	for _, msg := range messages {
+		from := msg.Sender
+		if msg.FromMe {
+			from = conn.irc.Nick()
+		}
+
+		to := conn.irc.Nick()
+		if item.chat.IsGroupChat || msg.FromMe {
+			to = item.Identifier
+		}
+
+		for _, line := range strings.Split(conn.archivedMessageBody(msg), "\n") {
+			str := ircConnection.FormatPrivateMessage(from, to, line)
+			if err := conn.irc.Write(msg.Time(), str); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
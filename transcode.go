@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+	"whapp-irc/files"
+	"whapp-irc/whapp"
+)
+
+const (
+	// voiceNoteExtension is the extension of the browser-friendly variant of
+	// voice notes.
+	voiceNoteExtension = "mp3"
+
+	// transcodeTimeout is the maximum duration ffmpeg may take to transcode a
+	// single voice note.
+	transcodeTimeout = 5 * time.Minute
+)
+
+var ffmpegDurationRegex = regexp.MustCompile(`Duration: (\d+):(\d+):(\d+)\.(\d+)`)
+
+// parseFFmpegDuration parses the duration of the input file from the given
+// ffmpeg output.
+func parseFFmpegDuration(output []byte) (time.Duration, bool) {
+	match := ffmpegDurationRegex.FindSubmatch(output)
+	if match == nil {
+		return 0, false
+	}
+
+	var res time.Duration
+	for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		n, err := strconv.Atoi(string(match[i+1]))
+		if err != nil {
+			return 0, false
+		}
+		res += time.Duration(n) * unit
+	}
+	return res, true
+}
+
+// transcodeAudio transcodes the audio file at the given path to mp3 using
+// ffmpeg, it returns the transcoded bytes and the duration of the audio
+// reported by ffmpeg.
+// ffmpeg is killed when ctx is done or when it takes longer than
+// transcodeTimeout.
+func transcodeAudio(ctx context.Context, path string) (res []byte, duration time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(ctx, transcodeTimeout)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "whapp-irc-transcode")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out."+voiceNoteExtension)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(
+		ctx,
+		getConfig().FFmpegPath,
+		"-nostdin",
+		"-i", path,
+		"-vn",
+		"-codec:a", "libmp3lame",
+		"-q:a", "4",
+		out,
+	)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, 0, fmt.Errorf("error while running ffmpeg: %s", err)
+	}
+
+	res, err = ioutil.ReadFile(out)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	duration, _ = parseFFmpegDuration(stderr.Bytes())
+	return res, duration, nil
+}
+
+// postProcessMedia runs the optional post-processing stage for the media of the
+// given message, which has been stored as file.
+// Currently this transcodes voice notes to a variant that is playable in most
+// browsers, and stores their duration.
+func postProcessMedia(ctx context.Context, file *files.File, msg whapp.Message) error {
+	if msg.Type != "ptt" || !getConfig().Users.Get(file.User).TranscodeVoiceNotes {
+		return nil
+	} else if fs.HasVariant(file, voiceNoteExtension) {
+		return nil
+	}
+
+	bytes, duration, err := transcodeAudio(ctx, file.Path)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.AddVariant(file, voiceNoteExtension, bytes); err != nil {
+		return err
+	}
+
+	if _, known := msg.MediaDuration(); known || duration == 0 {
+		return nil
+	}
+	return fs.UpdateInfo(file, func(info *files.Info) {
+		info.Duration = int(duration / time.Second)
+	})
+}
+
+// formatDuration formats the given duration as m:ss or h:mm:ss.
+func formatDuration(d time.Duration) string {
+	seconds := int(d / time.Second)
+	h, m, s := seconds/3600, seconds/60%60, seconds%60
+
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
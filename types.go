@@ -5,6 +5,7 @@ import (
 	"whapp-irc/whapp"
 )
 
+// messageIDListSize is the amount of message IDs remembered per chat.
 const messageIDListSize = 750
 
 var numberRegex = regexp.MustCompile(`^\+[\d ]+$`)
@@ -37,8 +38,7 @@ type Chat struct {
 	IsGroupChat  bool
 	Participants []Participant
 
-	Joined     bool
-	MessageIDs []string
+	Joined bool
 
 	rawChat whapp.Chat
 }
@@ -63,29 +63,12 @@ func (c *Chat) Identifier() string {
 	return prefix + name
 }
 
-// AddMessageID adds the given id to the chat, so that it's known as
-// received/sent.
-func (c *Chat) AddMessageID(id string) {
-	if len(c.MessageIDs) >= messageIDListSize {
-		c.MessageIDs = c.MessageIDs[1:]
-	}
-	c.MessageIDs = append(c.MessageIDs, id)
-}
-
-// HasMessageID returns whether or not a message with the given id has been
-// received/sent in the current chat.
-func (c *Chat) HasMessageID(id string) bool {
-	for _, x := range c.MessageIDs {
-		if x == id {
-			return true
-		}
-	}
-	return false
-}
-
 // User represents a user of the bridge.
+// LocalStorage contains the WhatsApp session keys, so users are stored
+// encrypted when a key is available (see makeUserDb).
 type User struct {
-	LocalStorage         map[string]string `json:"localStorage"`
-	LastReceivedReceipts map[string]int64  `json:"lastReceivedReceipts"`
-	Chats                []ChatListItem    `json:"chats"`
+	LocalStorage         map[string]string   `json:"localStorage,omitempty"`
+	LastReceivedReceipts map[string]int64    `json:"lastReceivedReceipts"`
+	Chats                []ChatListItem      `json:"chats"`
+	MessageIDs           map[string][]string `json:"messageIds"`
 }
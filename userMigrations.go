@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"whapp-irc/database"
+	"whapp-irc/whapp"
+)
+
+// userMigrations are the migrations for stored users, userMigrations[i]
+// migrates a user stored with version i to version i+1.
+// Never change or remove an existing migration, add a new one instead.
+var userMigrations = []database.Migration{
+	migrateUserChatIDs,
+}
+
+// migrateUserChatIDs migrates users stored before versioning was introduced,
+// which stored the IDs of chats as a whapp.ID object, to store them as
+// user@server.
+func migrateUserChatIDs(data json.RawMessage) (json.RawMessage, error) {
+	var user map[string]json.RawMessage
+	if err := json.Unmarshal(data, &user); err != nil {
+		return nil, err
+	}
+
+	var chats []map[string]json.RawMessage
+	if raw, has := user["chats"]; has {
+		if err := json.Unmarshal(raw, &chats); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, chat := range chats {
+		var id whapp.ID
+		if err := json.Unmarshal(chat["id"], &id); err != nil {
+			return nil, err
+		}
+
+		raw, err := json.Marshal(id.String())
+		if err != nil {
+			return nil, err
+		}
+		chat["id"] = raw
+	}
+
+	raw, err := json.Marshal(chats)
+	if err != nil {
+		return nil, err
+	}
+	user["chats"] = raw
+
+	return json.Marshal(user)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"whapp-irc/database"
+	"whapp-irc/whapp"
+)
+
+// expectedUser is the user stored in the fixtures in testdata/users.
+// v0.json has been stored before message IDs were saved.
+var expectedUser = User{
+	LocalStorage: map[string]string{
+		"WABrowserId": `"abc"`,
+		"WAToken1":    `"token"`,
+	},
+	LastReceivedReceipts: map[string]int64{
+		"31612345678@c.us":            1546300800,
+		"31612345678-1546300000@g.us": 1546300900,
+	},
+	Chats: []ChatListItem{
+		{
+			Identifier: "alice",
+			ID:         whapp.ID{User: "31612345678", Server: "c.us"},
+		},
+		{
+			Identifier: "#family",
+			ID:         whapp.ID{User: "31612345678-1546300000", Server: "g.us"},
+		},
+	},
+	MessageIDs: map[string][]string{
+		"31612345678@c.us": {"true_31612345678@c.us_3EB0ABCDEF"},
+	},
+}
+
+// loadFixtureDb returns a database containing the given fixture from
+// testdata/users as the user "fixture".
+func loadFixtureDb(t *testing.T, fixture string) (db *database.Database, storage database.Storage, cleanup func()) {
+	bytes, err := ioutil.ReadFile(filepath.Join("testdata", "users", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "whapp-irc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+
+	storage, err = database.MakeFileStorage(dir)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	if err := storage.Put("fixture", bytes); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return database.MakeDatabase(storage, userMigrations...), storage, cleanup
+}
+
+func TestUserMigrations(t *testing.T) {
+	for _, fixture := range []string{"v0.json", "unversioned.json", "v1.json"} {
+		db, storage, cleanup := loadFixtureDb(t, fixture)
+		defer cleanup()
+
+		expected := expectedUser
+		if fixture == "v0.json" {
+			expected.MessageIDs = nil
+		}
+
+		var user User
+		found, err := db.GetItem("fixture", &user)
+		if err != nil || !found {
+			t.Errorf("%s: got found %t and error %v", fixture, found, err)
+			continue
+		} else if !reflect.DeepEqual(user, expected) {
+			t.Errorf("%s: got %+v, expected %+v", fixture, user, expected)
+		}
+
+		// the user should be stored using the current layout now, and
+		// load the same again.
+		var stored struct {
+			Version int `json:"version"`
+		}
+		bytes, _, err := storage.Get("fixture")
+		if err == nil {
+			err = json.Unmarshal(bytes, &stored)
+		}
+		if err != nil {
+			t.Errorf("%s: %s", fixture, err)
+		} else if stored.Version != db.Version() {
+			t.Errorf("%s: stored with version %d after loading, expected %d", fixture, stored.Version, db.Version())
+		}
+
+		if err := db.SaveItem("fixture", user); err != nil {
+			t.Errorf("%s: %s", fixture, err)
+			continue
+		}
+
+		var loaded User
+		if _, err := db.GetItem("fixture", &loaded); err != nil {
+			t.Errorf("%s: %s", fixture, err)
+		} else if !reflect.DeepEqual(loaded, user) {
+			t.Errorf("%s: got %+v after saving, expected %+v", fixture, loaded, user)
+		}
+	}
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"encoding/hex"
-	"log"
+	"fmt"
 	"mime"
 	"regexp"
 	"strconv"
@@ -75,7 +75,17 @@ func plural(count int, singular, plural string) string {
 	return plural
 }
 
-func logMessage(time time.Time, from, to, message string) {
-	timeStr := time.Format("2006-01-02 15:04:05")
-	log.Printf("(%s) %s->%s: %s", timeStr, from, to, message)
+// formatSize formats the given amount of bytes in a human readable way.
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
@@ -3,46 +3,137 @@ package whapp
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"io"
 
 	"golang.org/x/crypto/hkdf"
 )
 
-func decryptFile(fileBytes []byte, mediaKeyb64, cryptKey string) ([]byte, error) {
+// macLength is the length of the truncated HMAC appended to encrypted media.
+const macLength = 10
+
+// decryptBufferSize is the size of the chunks in which media is decrypted, it
+// has to be a multiple of aes.BlockSize.
+const decryptBufferSize = 32 * 1024
+
+type mediaKeys struct {
+	iv        []byte
+	cipherKey []byte
+	macKey    []byte
+}
+
+func deriveMediaKeys(mediaKeyb64, cryptKey string) (mediaKeys, error) {
 	mediaKey, err := base64.StdEncoding.DecodeString(mediaKeyb64)
 	if err != nil {
-		return []byte{}, err
+		return mediaKeys{}, err
 	}
 
 	cryptKeyBytes, err := hex.DecodeString(cryptKey)
 	if err != nil {
-		return []byte{}, err
+		return mediaKeys{}, err
 	}
 
 	hash := hkdf.New(sha256.New, mediaKey, nil, cryptKeyBytes)
-	bytes := make([]byte, 112)
-	if _, err = hash.Read(bytes); err != nil {
-		return []byte{}, err
+	keys := make([]byte, 112)
+	if _, err = hash.Read(keys); err != nil {
+		return mediaKeys{}, err
+	}
+
+	return mediaKeys{
+		iv:        keys[:16],
+		cipherKey: keys[16 : 16+32],
+		macKey:    keys[16+32 : 16+32+32],
+	}, nil
+}
+
+// unpad removes the PKCS7 padding from the given bytes.
+func unpad(data []byte) ([]byte, error) {
+	n := len(data)
+	if n == 0 || n%aes.BlockSize != 0 {
+		return nil, ErrMediaCorrupt
+	}
+
+	padding := int(data[n-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, ErrMediaCorrupt
+	}
+	for _, b := range data[n-padding:] {
+		if int(b) != padding {
+			return nil, ErrMediaCorrupt
+		}
+	}
+
+	return data[:n-padding], nil
+}
+
+// decryptFile reads the encrypted file of the given size (including the
+// trailing MAC) from src, and writes the decrypted file to dst.
+// The MAC is only verified once everything has been read, so when
+// ErrMediaCorrupt is returned the bytes written to dst should be discarded.
+func decryptFile(dst io.Writer, src io.Reader, size int64, mediaKeyb64, cryptKey string) error {
+	keys, err := deriveMediaKeys(mediaKeyb64, cryptKey)
+	if err != nil {
+		return err
 	}
 
-	iv := bytes[:16]
-	chiperKey := bytes[16 : 16+32]
-	eFile := fileBytes[:len(fileBytes)-10]
+	encryptedSize := size - macLength
+	if encryptedSize < aes.BlockSize || encryptedSize%aes.BlockSize != 0 {
+		return ErrMediaCorrupt
+	}
 
-	block, err := aes.NewCipher(chiperKey)
+	block, err := aes.NewCipher(keys.cipherKey)
 	if err != nil {
-		return []byte{}, err
+		return err
 	}
+	mode := cipher.NewCBCDecrypter(block, keys.iv)
+
+	// the MAC is calculated over the IV and the encrypted file.
+	mac := hmac.New(sha256.New, keys.macKey)
+	mac.Write(keys.iv)
+
+	// the last decrypted block is held back, since it contains the padding.
+	buf := make([]byte, decryptBufferSize)
+	last := make([]byte, 0, aes.BlockSize)
+
+	for remaining := encryptedSize; remaining > 0; {
+		n := int64(len(buf))
+		if remaining < n {
+			n = remaining
+		}
+		chunk := buf[:n]
 
-	rawSize := len(eFile)
-	for len(eFile)%aes.BlockSize != 0 {
-		eFile = append(eFile, 0)
+		if _, err := io.ReadFull(src, chunk); err != nil {
+			return err
+		}
+		mac.Write(chunk)
+		mode.CryptBlocks(chunk, chunk)
+
+		if _, err := dst.Write(last); err != nil {
+			return err
+		}
+		if _, err := dst.Write(chunk[:n-aes.BlockSize]); err != nil {
+			return err
+		}
+		last = append(last[:0], chunk[n-aes.BlockSize:]...)
+
+		remaining -= n
 	}
 
-	mode := cipher.NewCBCDecrypter(block, iv)
-	mode.CryptBlocks(eFile, eFile)
+	expected := make([]byte, macLength)
+	if _, err := io.ReadFull(src, expected); err != nil {
+		return err
+	}
+	if !hmac.Equal(mac.Sum(nil)[:macLength], expected) {
+		return ErrMediaCorrupt
+	}
 
-	return eFile[:rawSize], nil
+	last, err = unpad(last)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(last)
+	return err
 }
@@ -0,0 +1,134 @@
+package whapp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+	"whapp-irc/logger"
+)
+
+// DownloadOptions contains the limits used when downloading media.
+type DownloadOptions struct {
+	// MaxSize is the maximum size in bytes of the encrypted media, zero means
+	// no limit.
+	MaxSize int64
+	// Timeout is the maximum duration of a single download attempt, zero means
+	// no timeout.
+	Timeout time.Duration
+	// Retries is the amount of times a failed download is resumed before
+	// giving up.
+	Retries int
+}
+
+// ExceedsMaxSize returns whether or not the given size is larger than the
+// maximum size allowed by the current options.
+func (opts DownloadOptions) ExceedsMaxSize(size int64) bool {
+	return opts.MaxSize > 0 && size > opts.MaxSize
+}
+
+// downloadAttempt downloads the file at the given url, starting at the given
+// offset, and appends it to f.
+func downloadAttempt(ctx context.Context, url string, f *os.File, offset int64, opts DownloadOptions) error {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		// the server doesn't support resuming (or we didn't ask for it), start
+		// over.
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		offset = 0
+
+	case http.StatusPartialContent:
+		break
+
+	case http.StatusRequestedRangeNotSatisfiable:
+		if offset > 0 {
+			// we already have the whole file.
+			return nil
+		}
+		fallthrough
+
+	default:
+		return fmt.Errorf("unexpected HTTP status %s", res.Status)
+	}
+
+	if res.ContentLength >= 0 && opts.ExceedsMaxSize(offset+res.ContentLength) {
+		return ErrMediaTooLarge
+	}
+
+	body := io.Reader(res.Body)
+	if opts.MaxSize > 0 {
+		body = io.LimitReader(body, opts.MaxSize-offset+1)
+	}
+
+	n, err := io.Copy(f, body)
+	if err != nil {
+		return err
+	} else if opts.ExceedsMaxSize(offset + n) {
+		return ErrMediaTooLarge
+	}
+	return nil
+}
+
+// downloadFile downloads the file at the given url to f, resuming the download
+// with exponential backoff when it fails. It returns the size of the
+// downloaded file.
+func downloadFile(ctx context.Context, log *logger.Logger, url string, f *os.File, opts DownloadOptions) (int64, error) {
+	var err error
+
+	for i := 0; i <= opts.Retries; i++ {
+		if i > 0 {
+			backoff := time.Duration(1<<uint(i-1)) * time.Second
+			log.Warningf("error while downloading media, retrying in %s: %s", backoff, err)
+
+			select {
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			case <-time.After(backoff):
+			}
+		}
+
+		var offset int64
+		offset, err = f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+
+		err = downloadAttempt(ctx, url, f, offset, opts)
+		if err == nil {
+			return f.Seek(0, io.SeekEnd)
+		} else if err == ErrMediaTooLarge || ctx.Err() != nil {
+			return 0, err
+		}
+	}
+
+	return 0, err
+}
@@ -7,15 +7,14 @@ const (
 	// Loggedout is the state of a logged out instance.
 	Loggedout LoginState = iota
 	// Loggedin is the state of a logged in instance.
-	Loggedin = iota
+	Loggedin LoginState = iota
 )
 
-// LoggingLevel represents the level of logging by the CDP instance.
-type LoggingLevel int
-
-const (
-	// LogLevelVerbose is the highest level of logging verbosity.
-	LogLevelVerbose LoggingLevel = iota
-	// LogLevelNormal is the normal level of logging verbosity.
-	LogLevelNormal = iota
-)
+func (s LoginState) String() string {
+	switch s {
+	case Loggedin:
+		return "loggedin"
+	default:
+		return "loggedout"
+	}
+}
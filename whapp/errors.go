@@ -13,3 +13,11 @@ var ErrLoggedOut = errors.New("logged out, should be logged in")
 // ErrCDPUnknown will be returned in some cases as an error when the called
 // function/method encountered an unknown error with CDP.
 var ErrCDPUnknown = errors.New("unknown CDP error")
+
+// ErrMediaCorrupt will be returned as an error when downloaded media failed
+// to verify or decrypt, because it has been corrupted or tampered with.
+var ErrMediaCorrupt = errors.New("media is corrupt or has been tampered with")
+
+// ErrMediaTooLarge will be returned as an error when media is larger than the
+// maximum size allowed.
+var ErrMediaTooLarge = errors.New("media is too large")
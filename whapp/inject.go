@@ -6,7 +6,12 @@ import (
 	"github.com/chromedp/chromedp"
 )
 
+// inject injects the script used to communicate with WhatsApp Web, unless it's
+// already injected. Only one goroutine injects at a time, others wait for it.
 func (wi *Instance) inject(ctx context.Context) error {
+	wi.injectMutex.Lock()
+	defer wi.injectMutex.Unlock()
+
 	if wi.injected {
 		return nil
 	}
@@ -339,6 +344,8 @@ func (wi *Instance) inject(ctx context.Context) error {
 
 	var idc []byte
 	if err := wi.cdp.Run(ctx, chromedp.Evaluate(script, &idc)); err != nil {
+		injectionFailures.Inc()
+		wi.log.Warningf("error while injecting script: %s", err)
 		return err
 	}
 
@@ -346,9 +353,38 @@ func (wi *Instance) inject(ctx context.Context) error {
 		ctx,
 		chromedp.Evaluate("whappGo.setupStore()", &idc, awaitPromise),
 	); err != nil {
+		injectionFailures.Inc()
+		wi.log.Warningf("error while setting up injected script: %s", err)
 		return err
 	}
 
+	wi.log.Debugf("injected script")
 	wi.injected = true
 	return nil
 }
+
+// checkInjected checks whether the injected script is still there, it's gone
+// after WhatsApp Web reloaded. When it's gone it's injected again the next
+// time it's needed.
+func (wi *Instance) checkInjected(ctx context.Context) error {
+	wi.injectMutex.Lock()
+	defer wi.injectMutex.Unlock()
+
+	if !wi.injected {
+		return nil
+	}
+
+	var present bool
+	if err := wi.cdp.Run(
+		ctx,
+		chromedp.Evaluate("typeof whappGo !== 'undefined'", &present),
+	); err != nil {
+		return err
+	}
+
+	if !present {
+		wi.log.Warningf("WhatsApp Web reloaded, injecting again")
+		wi.injected = false
+	}
+	return nil
+}
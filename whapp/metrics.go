@@ -0,0 +1,27 @@
+package whapp
+
+import "whapp-irc/metrics"
+
+var mediaDownloadDurationBuckets = []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+var (
+	pollDuration = metrics.NewHistogram(
+		"whapp_irc_poll_duration_seconds",
+		"The duration of polling WhatsApp Web for new messages.",
+		metrics.DefaultBuckets,
+	)
+	injectionFailures = metrics.NewCounter(
+		"whapp_irc_injection_failures_total",
+		"The amount of times injecting the script into WhatsApp Web failed.",
+	)
+
+	mediaDownloadBytes = metrics.NewCounter(
+		"whapp_irc_media_download_bytes_total",
+		"The amount of bytes of media downloaded.",
+	)
+	mediaDownloadDuration = metrics.NewHistogram(
+		"whapp_irc_media_download_duration_seconds",
+		"The duration of downloading and decrypting media.",
+		mediaDownloadDurationBuckets,
+	)
+)
@@ -1,13 +1,18 @@
 package whapp
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"whapp-irc/logger"
 
 	"github.com/chromedp/chromedp"
 )
@@ -223,6 +228,9 @@ type Message struct {
 	MediaFilename  string    `json:"filename"`
 	Caption        string    `json:"caption"`
 
+	// Duration is the duration in seconds of audio and video messages.
+	Duration json.Number `json:"duration"`
+
 	Location *LocationData `json:"location"`
 
 	PDFPageCount uint `json:"pageCount"`
@@ -232,18 +240,51 @@ type Message struct {
 	Chat Chat `json:"chat"`
 }
 
-// DownloadMedia downloads the media included in this message, if any
-func (msg Message) DownloadMedia() ([]byte, error) {
+// DownloadMedia downloads the media included in this message, if any, and
+// writes the decrypted media to dst. Failed attempts are logged to log.
+// The encrypted media is temporarily stored in tmp, which should be empty.
+func (msg Message) DownloadMedia(ctx context.Context, log *logger.Logger, dst io.Writer, tmp *os.File, opts DownloadOptions) error {
 	if !msg.IsMMS {
-		return []byte{}, nil
+		return nil
+	} else if opts.ExceedsMaxSize(msg.MediaData.Size) {
+		return ErrMediaTooLarge
 	}
 
-	fileBytes, err := downloadFile(msg.MediaClientURL)
+	start := time.Now()
+	if err := msg.downloadMedia(ctx, log, dst, tmp, opts); err != nil {
+		return err
+	}
+	mediaDownloadDuration.ObserveSince(start)
+	return nil
+}
+
+func (msg Message) downloadMedia(ctx context.Context, log *logger.Logger, dst io.Writer, tmp *os.File, opts DownloadOptions) error {
+	size, err := downloadFile(ctx, log, msg.MediaClientURL, tmp, opts)
 	if err != nil {
-		return []byte{}, err
+		return err
 	}
+	mediaDownloadBytes.Add(float64(size))
 
-	return decryptFile(fileBytes, msg.MediaKey, getCryptKey(msg.Type))
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return decryptFile(
+		dst,
+		bufio.NewReader(tmp),
+		size,
+		msg.MediaKey,
+		getCryptKey(msg.Type),
+	)
+}
+
+// MediaDuration returns the duration of the audio or video included in this
+// message, and whether or not it is known.
+func (msg Message) MediaDuration() (time.Duration, bool) {
+	seconds, err := msg.Duration.Float64()
+	if err != nil || seconds <= 0 {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
 }
 
 // FormatBody returns the body of the current message, with mentions correctly
@@ -2,8 +2,6 @@ package whapp
 
 import (
 	"context"
-	"io/ioutil"
-	"net/http"
 
 	"github.com/chromedp/cdproto/runtime"
 	"github.com/chromedp/chromedp"
@@ -13,16 +11,6 @@ func awaitPromise(params *runtime.EvaluateParams) *runtime.EvaluateParams {
 	return params.WithAwaitPromise(true)
 }
 
-func downloadFile(url string) ([]byte, error) {
-	res, err := http.Get(url)
-	if err != nil {
-		return []byte{}, err
-	}
-	defer res.Body.Close()
-
-	return ioutil.ReadAll(res.Body)
-}
-
 func runLoggedinWithoutRes(ctx context.Context, wi *Instance, code string, await bool) error {
 	// REVIEW: find some better way than 'idc'
 
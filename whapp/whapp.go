@@ -4,10 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
+	"whapp-irc/logger"
 
 	"github.com/chromedp/chromedp"
 	"github.com/chromedp/chromedp/client"
@@ -38,11 +40,45 @@ func (u *poolUnit) Shutdown(ctx context.Context, opts ...client.Option) error {
 
 // Instance is an instance to Whatsapp Web.
 type Instance struct {
+	// lastPoll is the time of the last successful poll for new messages, in
+	// nanoseconds since the unix epoch. It's accessed atomically, and is the
+	// first field to keep it 64-bit aligned.
+	lastPoll int64
+
 	LoginState LoginState
 
-	unit     internalUnit
-	cdp      *chromedp.CDP
-	injected bool
+	unit internalUnit
+	cdp  *chromedp.CDP
+	log  *logger.Logger
+
+	// injectMutex is held while injecting the script or checking whether it's
+	// still there, and guards injected.
+	injectMutex sync.Mutex
+	injected    bool
+}
+
+// maxPollFailures is the amount of consecutive failed polls after which a
+// listener gives up. Polls fail for a short while when WhatsApp Web reloads.
+const maxPollFailures = 3
+
+// pollTimeout is the maximum duration of a single poll of a listener, a poll
+// taking longer counts as a failed poll.
+const pollTimeout = 15 * time.Second
+
+// pollFailed is called by a listener when a poll failed the given amount of
+// consecutive times, and returns whether the listener should give up.
+func (wi *Instance) pollFailed(ctx context.Context, failures int, err error) (giveUp bool) {
+	if failures >= maxPollFailures || ctx.Err() != nil {
+		return true
+	}
+
+	wi.log.Debugf("poll failed, trying again: %s", err)
+
+	// when the browser doesn't respond at all it has probably crashed, so
+	// there's no use in trying again.
+	ctx, cancel := context.WithTimeout(ctx, pollTimeout)
+	defer cancel()
+	return wi.checkInjected(ctx) != nil
 }
 
 func getOptions(headless bool) []runner.CommandLineOption {
@@ -61,22 +97,20 @@ func getOptions(headless bool) []runner.CommandLineOption {
 	}
 }
 
-// MakeInstance makes a new Instance.
+// MakeInstance makes a new Instance, which logs to log.
+// The communication with chromium is logged when logger.CDPTraffic is enabled.
 func MakeInstance(
 	ctx context.Context,
 	headless bool,
-	loggingLevel LoggingLevel,
+	log *logger.Logger,
 ) (*Instance, error) {
 	options := chromedp.WithRunnerOptions(getOptions(headless)...)
 
-	cdp, err := func() (*chromedp.CDP, error) {
-		switch loggingLevel {
-		case LogLevelVerbose:
-			return chromedp.New(ctx, options, chromedp.WithLog(log.Printf))
-		default:
-			return chromedp.New(ctx, options)
-		}
-	}()
+	cdp, err := chromedp.New(
+		ctx,
+		options,
+		chromedp.WithLog(log.TraceFunc(logger.CDPTraffic)),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -84,18 +118,20 @@ func MakeInstance(
 	return &Instance{
 		LoginState: Loggedout,
 
-		unit:     cdp,
-		cdp:      cdp,
-		injected: false,
+		unit: cdp,
+		cdp:  cdp,
+		log:  log,
 	}, nil
 }
 
-// MakeInstanceWithPool makes a new Instance using the given pool.
+// MakeInstanceWithPool makes a new Instance using the given pool, which logs
+// to log.
+// The communication with chromium is logged by the pool.
 func MakeInstanceWithPool(
 	ctx context.Context,
 	pool *chromedp.Pool,
 	headless bool,
-	loggingLevel LoggingLevel,
+	log *logger.Logger,
 ) (*Instance, error) {
 	options := getOptions(headless)
 
@@ -107,9 +143,9 @@ func MakeInstanceWithPool(
 	return &Instance{
 		LoginState: Loggedout,
 
-		unit:     &poolUnit{res},
-		cdp:      res.CDP(),
-		injected: false,
+		unit: &poolUnit{res},
+		cdp:  res.CDP(),
+		log:  log,
 	}, nil
 }
 
@@ -214,6 +250,30 @@ func (wi *Instance) WaitLogin(ctx context.Context) error {
 	return nil
 }
 
+// Logout logs out of WhatsApp Web, which also unlinks the current instance from
+// the phone of the user.
+func (wi *Instance) Logout(ctx context.Context) error {
+	if wi.LoginState != Loggedin {
+		return ErrLoggedOut
+	}
+
+	if err := wi.cdp.Run(ctx, chromedp.Tasks{
+		chromedp.Click(`#side header [data-icon="menu"]`, chromedp.ByQuery),
+		chromedp.Click(`[title="Log out"]`, chromedp.ByQuery),
+		chromedp.WaitVisible("._2EZ_m"), // wait for the QR code
+	}); err != nil {
+		return err
+	}
+
+	// WhatsApp Web reloads when logging out, so the script has to be injected
+	// again.
+	wi.LoginState = Loggedout
+	wi.injectMutex.Lock()
+	wi.injected = false
+	wi.injectMutex.Unlock()
+	return nil
+}
+
 // GetMe returns the Me object for the current instance.
 func (wi *Instance) GetMe(ctx context.Context) (Me, error) {
 	var res Me
@@ -259,6 +319,7 @@ func (wi *Instance) ListenLoggedIn(ctx context.Context, interval time.Duration)
 
 		prev := false
 		first := true
+		failures := 0
 
 		for {
 			select {
@@ -266,14 +327,29 @@ func (wi *Instance) ListenLoggedIn(ctx context.Context, interval time.Duration)
 				return
 
 			case <-time.After(interval):
-				res, err := wi.getLoggedIn(ctx)
+				pollCtx, cancel := context.WithTimeout(ctx, pollTimeout)
+				res, err := wi.getLoggedIn(pollCtx)
+				cancel()
 				if err != nil {
-					errCh <- err
-					return
+					failures++
+					if wi.pollFailed(ctx, failures, err) {
+						// nobody reads errCh anymore once ctx is done.
+						select {
+						case errCh <- err:
+						case <-ctx.Done():
+						}
+						return
+					}
+					continue
 				}
+				failures = 0
 
 				if res != prev && !first {
-					resCh <- res
+					select {
+					case resCh <- res:
+					case <-ctx.Done():
+						return
+					}
 				}
 
 				prev = res
@@ -321,20 +397,39 @@ func (wi *Instance) ListenForMessages(ctx context.Context, interval time.Duratio
 		defer close(errCh)
 		defer close(messageCh)
 
+		failures := 0
+
 		for {
 			select {
 			case <-ctx.Done():
 				return
 
 			case <-time.After(interval):
-				res, err := wi.getNewMessages(ctx)
+				start := time.Now()
+				pollCtx, cancel := context.WithTimeout(ctx, pollTimeout)
+				res, err := wi.getNewMessages(pollCtx)
+				cancel()
+				pollDuration.ObserveSince(start)
 				if err != nil {
-					errCh <- err
-					return
+					failures++
+					if wi.pollFailed(ctx, failures, err) {
+						select {
+						case errCh <- err:
+						case <-ctx.Done():
+						}
+						return
+					}
+					continue
 				}
+				failures = 0
+				atomic.StoreInt64(&wi.lastPoll, time.Now().UnixNano())
 
 				for _, msg := range res {
-					messageCh <- msg
+					select {
+					case messageCh <- msg:
+					case <-ctx.Done():
+						return
+					}
 				}
 			}
 		}
@@ -343,6 +438,16 @@ func (wi *Instance) ListenForMessages(ctx context.Context, interval time.Duratio
 	return messageCh, errCh
 }
 
+// LastPoll returns the time of the last successful poll for new messages by
+// ListenForMessages, or the zero time if there hasn't been one.
+func (wi *Instance) LastPoll() time.Time {
+	nanos := atomic.LoadInt64(&wi.lastPoll)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
 // SendMessageToChatID sends the given `message` to the chat with the given
 // `chatID`.
 func (wi *Instance) SendMessageToChatID(ctx context.Context, chatID ID, message string) error {
@@ -416,6 +521,7 @@ func (wi *Instance) ListenForPhoneActiveChange(ctx context.Context, interval tim
 
 		prev := false
 		first := true
+		failures := 0
 
 		for {
 			select {
@@ -423,16 +529,30 @@ func (wi *Instance) ListenForPhoneActiveChange(ctx context.Context, interval tim
 				return
 
 			case <-time.After(interval):
-				res, err := wi.GetPhoneActive(ctx)
+				pollCtx, cancel := context.WithTimeout(ctx, pollTimeout)
+				res, err := wi.GetPhoneActive(pollCtx)
+				cancel()
 				if err != nil {
-					errCh <- err
-					return
+					failures++
+					if wi.pollFailed(ctx, failures, err) {
+						select {
+						case errCh <- err:
+						case <-ctx.Done():
+						}
+						return
+					}
+					continue
 				}
+				failures = 0
 
 				if first || res != prev {
 					prev = res
 					first = false
-					resCh <- res
+					select {
+					case resCh <- res:
+					case <-ctx.Done():
+						return
+					}
 				}
 			}
 		}
@@ -2,9 +2,8 @@ package main
 
 import (
 	"fmt"
-	"log"
-	"path/filepath"
 	"strings"
+	"time"
 	"whapp-irc/ircConnection"
 	"whapp-irc/maps"
 	"whapp-irc/whapp"
@@ -17,7 +16,45 @@ func formatContact(contact whapp.Contact) Participant {
 	}
 }
 
-func getMessageBody(msg whapp.Message, participants []Participant, me whapp.Me) string {
+// getMediaLine returns the line describing the media of the given message,
+// containing the URL to it when it has been stored.
+func (conn *Connection) getMediaLine(msg whapp.Message) string {
+	res := "--file--"
+	f, has := fs.GetFileByHash(conn.irc.Nick(), msg.MediaFileHash)
+	if has {
+		res = f.URL
+		if hasPreviewPage(msg.Type) {
+			res = f.PreviewURL()
+		}
+	} else if size := msg.MediaData.Size; getConfig().MediaDownloadOptions.ExceedsMaxSize(size) {
+		res = fmt.Sprintf("--file too large (%s)--", formatSize(size))
+	} else if conn.media.IsTooLarge(msg.MediaFileHash) {
+		maxSize := getConfig().MediaDownloadOptions.MaxSize
+		res = fmt.Sprintf("--file too large (over %s)--", formatSize(maxSize))
+	} else if conn.media.IsPending(msg.MediaFileHash) {
+		res = "--file, downloading--"
+	}
+
+	if msg.Type == "ptt" {
+		duration, known := msg.MediaDuration()
+		if has && !known {
+			if info, _, found := fs.GetInfo(f); found && info.Duration > 0 {
+				duration = time.Duration(info.Duration) * time.Second
+				known = true
+			}
+		}
+
+		if known {
+			res = fmt.Sprintf("voice note (%s): %s", formatDuration(duration), res)
+		} else {
+			res = "voice note: " + res
+		}
+	}
+
+	return res
+}
+
+func (conn *Connection) getMessageBody(msg whapp.Message, participants []Participant) string {
 	whappParticipants := make([]whapp.Participant, len(participants))
 	for i, p := range participants {
 		whappParticipants[i] = whapp.Participant(p)
@@ -25,54 +62,26 @@ func getMessageBody(msg whapp.Message, participants []Participant, me whapp.Me)
 
 	if msg.Location != nil {
 		return maps.ByProvider(
-			mapProvider,
+			conn.settings().MapProvider,
 			msg.Location.Latitude,
 			msg.Location.Longitude,
 		)
 	} else if msg.IsMMS {
-		res := "--file--"
-		if f, has := fs.GetFileByHash(msg.MediaFileHash); has {
-			res = f.URL
-		}
+		res := conn.getMediaLine(msg)
 
 		if msg.Caption != "" {
-			res += " " + msg.FormatCaption(whappParticipants, me.Pushname)
+			res += " " + msg.FormatCaption(whappParticipants, conn.me.Pushname)
 		}
 
 		return res
 	}
 
-	return msg.FormatBody(whappParticipants, me.Pushname)
-}
-
-func downloadAndStoreMedia(msg whapp.Message) error {
-	if _, has := fs.GetFileByHash(msg.MediaFileHash); msg.IsMMS && !has {
-		bytes, err := msg.DownloadMedia()
-		if err != nil {
-			return err
-		}
-
-		ext := getExtensionByMimeOrBytes(msg.MimeType, bytes)
-		if ext == "" {
-			ext = filepath.Ext(msg.MediaFilename)
-			if ext != "" {
-				ext = ext[1:]
-			}
-		}
-
-		if _, err := fs.AddBlob(
-			msg.MediaFileHash,
-			ext,
-			bytes,
-		); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return msg.FormatBody(whappParticipants, conn.me.Pushname)
 }
 
 func (conn *Connection) handleWhappMessage(msg whapp.Message) error {
+	conn.health.MessageReceived()
+
 	// HACK
 	if msg.Type == "e2e_notification" {
 		return nil
@@ -94,21 +103,24 @@ func (conn *Connection) handleWhappMessage(msg whapp.Message) error {
 		}
 	}
 
-	if chat.HasMessageID(msg.ID.Serialized) {
+	if !conn.messageIDs.Add(chat.ID.String(), msg.ID.Serialized) {
 		return nil // already handled
 	}
-	chat.AddMessageID(msg.ID.Serialized)
+	// the handled message IDs are saved too, even when the timestamp
+	// doesn't change.
+	conn.persister.MarkDirty()
 
 	lastTimestamp, found := conn.timestampMap.Get(chat.ID.String())
 	if !found || msg.Timestamp > lastTimestamp {
 		conn.timestampMap.Set(chat.ID.String(), msg.Timestamp)
-		go conn.saveDatabaseEntry()
 	}
 
 	if msg.IsNotification {
 		return conn.handleWhappNotification(item, msg)
 	}
 
+	conn.archiveMessage(chat, msg)
+
 	sender := formatContact(*msg.Sender)
 	senderSafeName := sender.SafeName()
 
@@ -118,6 +130,8 @@ func (conn *Connection) handleWhappMessage(msg whapp.Message) error {
 		senderSafeName = conn.irc.Nick()
 	}
 
+	messagesBridged.Inc(directionToIRC, msg.Type)
+
 	var to string
 	if chat.IsGroupChat || msg.IsSentByMe {
 		to = item.Identifier
@@ -125,12 +139,23 @@ func (conn *Connection) handleWhappMessage(msg whapp.Message) error {
 		to = conn.irc.Nick()
 	}
 
-	if err := downloadAndStoreMedia(msg); err != nil {
-		return err
+	// send the message right away, the media is downloaded in the background
+	// and its URL is sent when it's done.
+	// the download only starts after the message has been written, so that
+	// its URL is never sent before the message itself.
+	if conn.media.NeedsDownload(msg) {
+		written := make(chan struct{})
+		defer close(written)
+
+		conn.media.Enqueue(msg, written, func(err error) {
+			if err := conn.sendDeferredMedia(msg, senderSafeName, to, err); err != nil {
+				conn.log().With("chat", item.Identifier).Errorf("error sending deferred media: %s", err)
+			}
+		})
 	}
 
 	if msg.QuotedMessageObject != nil {
-		message := getMessageBody(*msg.QuotedMessageObject, chat.Participants, conn.me)
+		message := conn.getMessageBody(*msg.QuotedMessageObject, chat.Participants)
 		lines := strings.Split(message, "\n")
 
 		line := "> " + lines[0]
@@ -149,9 +174,9 @@ func (conn *Connection) handleWhappMessage(msg whapp.Message) error {
 		}
 	}
 
-	message := getMessageBody(msg, chat.Participants, conn.me)
+	message := conn.getMessageBody(msg, chat.Participants)
 	for _, line := range strings.Split(message, "\n") {
-		logMessage(msg.Time(), senderSafeName, to, line)
+		conn.logMessage(msg.Time(), senderSafeName, to, line)
 		str := ircConnection.FormatPrivateMessage(senderSafeName, to, line)
 		if err := conn.irc.Write(msg.Time(), str); err != nil {
 			return err
@@ -161,6 +186,20 @@ func (conn *Connection) handleWhappMessage(msg whapp.Message) error {
 	return nil
 }
 
+// sendDeferredMedia sends the follow-up line for the media of the given
+// message, once downloading it has finished with the given error.
+func (conn *Connection) sendDeferredMedia(msg whapp.Message, from, to string, downloadErr error) error {
+	line := conn.getMediaLine(msg)
+	if downloadErr != nil {
+		conn.log().With("chat", to).Warningf("error while downloading media: %s", downloadErr)
+		line = "--file, download failed--"
+	}
+
+	conn.logMessage(msg.Time(), from, to, line)
+	str := ircConnection.FormatPrivateMessage(from, to, line)
+	return conn.irc.Write(msg.Time(), str)
+}
+
 func (conn *Connection) handleWhappNotification(chatItem ChatListItem, msg whapp.Message) error {
 	chat := chatItem.chat
 
@@ -238,7 +277,7 @@ func (conn *Connection) handleWhappNotification(chatItem ChatListItem, msg whapp
 			}
 
 		default:
-			log.Printf("no idea what to do with notification subtype %s\n", msg.Subtype)
+			conn.log().With("chat", chatItem.Identifier).Warningf("no idea what to do with notification subtype %s", msg.Subtype)
 		}
 
 		if recipientSelf && (msg.Subtype == "leave" || msg.Subtype == "remove") {
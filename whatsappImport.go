@@ -0,0 +1,262 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"whapp-irc/archive"
+	"whapp-irc/files"
+)
+
+// exportSource contains the files of a chat exported using WhatsApp, which is
+// either a text file with the media next to it, or a zip file.
+type exportSource struct {
+	chat        io.ReadCloser
+	attachments func(name string) (io.ReadCloser, error)
+	close       func() error
+}
+
+// openExportSource opens the exported chat at the given path.
+func openExportSource(path string) (*exportSource, error) {
+	if strings.ToLower(filepath.Ext(path)) != ".zip" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		dir := filepath.Dir(path)
+		return &exportSource{
+			chat: f,
+			attachments: func(name string) (io.ReadCloser, error) {
+				return os.Open(filepath.Join(dir, filepath.Base(name)))
+			},
+			close: func() error { return nil },
+		}, nil
+	}
+
+	z, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var chat io.ReadCloser
+	byName := make(map[string]*zip.File)
+	for _, f := range z.File {
+		name := filepath.Base(f.Name)
+		byName[name] = f
+
+		if chat == nil && strings.ToLower(filepath.Ext(name)) == ".txt" {
+			if chat, err = f.Open(); err != nil {
+				z.Close()
+				return nil, err
+			}
+		}
+	}
+	if chat == nil {
+		z.Close()
+		return nil, fmt.Errorf("no chat found in %s", path)
+	}
+
+	return &exportSource{
+		chat: chat,
+		attachments: func(name string) (io.ReadCloser, error) {
+			f, has := byName[filepath.Base(name)]
+			if !has {
+				return nil, os.ErrNotExist
+			}
+			return f.Open()
+		},
+		close: z.Close,
+	}, nil
+}
+
+// importAttachment stores the given attachment of the given user on the file
+// server, and returns its hash. The hash is computed the same way WhatsApp
+// does, so media that has already been downloaded isn't stored twice.
+func importAttachment(user, name string, r io.Reader, info files.Info) (hash string, err error) {
+	tmp, err := fs.TempFile()
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	hash = base64.StdEncoding.EncodeToString(h.Sum(nil))
+	ext := strings.TrimPrefix(filepath.Ext(name), ".")
+	if _, err := fs.AddFile(user, hash, ext, tmp.Name(), info); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// mediaType returns the WhatsApp message type for the media with the given
+// file name.
+func mediaType(name string) string {
+	mimeType := mime.TypeByExtension(filepath.Ext(name))
+	for _, typ := range []string{"image", "video", "audio"} {
+		if strings.HasPrefix(mimeType, typ+"/") {
+			return typ
+		}
+	}
+	return "document"
+}
+
+// senderMapper maps sender names in an exported chat to IRC names, using the
+// private chats of the user.
+type senderMapper struct {
+	me    string
+	nick  string
+	chats []ChatListItem
+}
+
+// mapSender returns the IRC name of the sender with the given name, and
+// whether or not it's the user themselves.
+func (m senderMapper) mapSender(name string) (sender string, fromMe bool) {
+	if m.me != "" && name == m.me {
+		return m.nick, true
+	}
+
+	number := nonNumberRegex.ReplaceAllString(name, "")
+	safe := ircSafeString(name)
+	for _, item := range m.chats {
+		if item.ID.Server != "c.us" {
+			continue
+		}
+
+		if numberRegex.MatchString(name) && item.ID.User == number {
+			return item.Identifier, false
+		} else if strings.EqualFold(item.Identifier, safe) {
+			return item.Identifier, false
+		}
+	}
+	return safe, false
+}
+
+// importMessageID returns a stable ID for the given imported message, so that
+// importing the same export twice doesn't add the messages twice.
+// n is the amount of earlier messages in the export with the same contents.
+func importMessageID(msg archive.ImportedMessage, n int) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%d\x00%s\x00%s\x00%s\x00%d", msg.Time.Unix(), msg.Sender, msg.Body, msg.Attachment, n)
+	return "import-" + hex.EncodeToString(h.Sum(nil))
+}
+
+// importChat imports the chat exported using WhatsApp at the given path into
+// the archive of the given user, as the chat with the given identifier or ID.
+// me is the name of the user in the export, if known, and loc is the location
+// of the phone it was exported from.
+func importChat(user, chat, path, me string, order archive.DateOrder, loc *time.Location) (n int, err error) {
+	if messageArchive == nil {
+		return 0, fmt.Errorf("the message archive is disabled")
+	}
+
+	stored, chatID, chatName, err := getStoredChat(user, chat)
+	if err != nil {
+		return 0, err
+	}
+
+	src, err := openExportSource(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.close()
+	defer src.chat.Close()
+
+	messages, err := archive.ParseWhatsAppExport(src.chat, order, loc)
+	if err != nil {
+		return 0, err
+	}
+
+	existing, err := messageArchive.Find(user, chatID, archive.Query{})
+	if err != nil {
+		return 0, err
+	}
+	known := make(map[string]bool)
+	for _, msg := range existing {
+		known[msg.ID] = true
+	}
+
+	mapper := senderMapper{
+		me:    me,
+		nick:  user,
+		chats: stored.Chats,
+	}
+
+	seen := make(map[string]int)
+	for _, msg := range messages {
+		key := importMessageID(msg, 0)
+		id := importMessageID(msg, seen[key])
+		seen[key]++
+		if known[id] {
+			continue
+		}
+
+		sender, fromMe := mapper.mapSender(msg.Sender)
+		item := archive.Message{
+			ID:        id,
+			Timestamp: msg.Time.Unix(),
+			Chat:      chatID,
+			Sender:    sender,
+			FromMe:    fromMe,
+			Type:      "chat",
+			Body:      msg.Body,
+		}
+
+		if msg.Attachment != "" {
+			item.Type = mediaType(msg.Attachment)
+			if err := importMessageAttachment(src, user, chatName, msg, &item); err != nil {
+				fmt.Fprintf(os.Stderr, "not importing attachment %s: %s\n", msg.Attachment, err)
+				item.Body = strings.TrimSpace(fmt.Sprintf("--file %s-- %s", msg.Attachment, item.Body))
+			}
+		}
+
+		if err := messageArchive.Add(user, item); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// importMessageAttachment stores the attachment of the given imported message
+// and sets its hash on item.
+func importMessageAttachment(src *exportSource, user, chatName string, msg archive.ImportedMessage, item *archive.Message) error {
+	r, err := src.attachments(msg.Attachment)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	hash, err := importAttachment(user, msg.Attachment, r, files.Info{
+		Filename:  msg.Attachment,
+		MimeType:  mime.TypeByExtension(filepath.Ext(msg.Attachment)),
+		Sender:    item.Sender,
+		Chat:      chatName,
+		Timestamp: item.Timestamp,
+		Caption:   item.Body,
+	})
+	if err != nil {
+		return err
+	}
+
+	item.MediaHash = hash
+	return nil
+}